@@ -0,0 +1,131 @@
+package sup
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// supfileSecret matches "KEY: value" and "KEY=value" lines of Supfile
+// env vars.
+var supfileSecret = regexp.MustCompile(`^(\s*(?:-\s*)?["']?)([A-Z_][A-Z0-9_]*)(["']?\s*[:=]\s*)(\S.*)$`)
+
+// Archive collects the output of the commands on each host, to be written
+// by Write along with the Supfile, env and summary of the run into a single
+// .tar.gz file, ie. to attach to a change ticket. Register its Output
+// method by Stackup.OnOutput.
+type Archive struct {
+	mu      sync.Mutex
+	hosts   []string              // In the order of the first output.
+	outputs map[string]*[2][]byte // STDOUT and STDERR, by host.
+}
+
+func NewArchive() *Archive {
+	return &Archive{outputs: map[string]*[2][]byte{}}
+}
+
+// Output collects the output of a host.
+func (a *Archive) Output(o Output) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	out, ok := a.outputs[o.Host]
+	if !ok {
+		out = &[2][]byte{}
+		a.outputs[o.Host] = out
+		a.hosts = append(a.hosts, o.Host)
+	}
+	i := 0
+	if o.Stderr {
+		i = 1
+	}
+	out[i] = append(out[i], o.Data...)
+}
+
+// Write writes the archive. Values of the env vars matching SecretEnvPattern
+// are redacted from all of its files, including the output of the hosts.
+func (a *Archive) Write(w io.Writer, supfile []byte, env EnvList, summary Summary, results []Result) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	redactor := NewRedactor(env)
+	var envFile bytes.Buffer
+	for _, v := range env {
+		if SecretEnvPattern.MatchString(v.Key) {
+			envFile.WriteString(v.Key + "=" + Redacted + "\n")
+		} else {
+			envFile.WriteString(v.Key + "=" + v.Value + "\n")
+		}
+	}
+
+	summaryJSON, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return err
+	}
+	var audit bytes.Buffer
+	for _, res := range results {
+		if err := WriteAudit(&audit, summary.Network, res, redactor); err != nil {
+			return err
+		}
+	}
+
+	files := []archiveFile{
+		{"Supfile", redactSupfile(supfile)},
+		{"env", envFile.Bytes()},
+		{"commands", []byte(strings.Join(summary.Commands, "\n") + "\n")},
+		{"summary.json", append(summaryJSON, '\n')},
+		{"audit.jsonl", audit.Bytes()},
+	}
+	for _, host := range a.hosts {
+		dir := "hosts/" + strings.Replace(host, "/", "_", -1) + "/"
+		files = append(files,
+			archiveFile{dir + "stdout.log", a.outputs[host][0]},
+			archiveFile{dir + "stderr.log", a.outputs[host][1]},
+		)
+	}
+
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	now := time.Now().Truncate(time.Second)
+	for _, f := range files {
+		data := redactor.Redact(f.data)
+		if err := tw.WriteHeader(&tar.Header{
+			Name:    f.name,
+			Mode:    0600,
+			Size:    int64(len(data)),
+			ModTime: now,
+		}); err != nil {
+			return err
+		}
+		if _, err := tw.Write(data); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+type archiveFile struct {
+	name string
+	data []byte
+}
+
+// redactSupfile redacts values of the Supfile's env vars matching
+// SecretEnvPattern, ie. "DB_PASSWORD: hunter2".
+func redactSupfile(data []byte) []byte {
+	lines := strings.Split(string(data), "\n")
+	for i, line := range lines {
+		m := supfileSecret.FindStringSubmatch(line)
+		if m != nil && SecretEnvPattern.MatchString(m[2]) {
+			lines[i] = m[1] + m[2] + m[3] + Redacted
+		}
+	}
+	return []byte(strings.Join(lines, "\n"))
+}
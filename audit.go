@@ -0,0 +1,40 @@
+package sup
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+)
+
+// auditRecord is a single line of the audit log.
+type auditRecord struct {
+	Time     time.Time `json:"time"`
+	Network  string    `json:"network"`
+	Host     string    `json:"host"`
+	Command  string    `json:"command"`
+	Resolved string    `json:"resolved"`
+	ExitCode int       `json:"exit_code"`
+	Ignored  bool      `json:"ignored,omitempty"`
+	Duration float64   `json:"duration_seconds"`
+}
+
+// WriteAudit writes the result as a single line of JSON, recording the
+// exact command string that ran on the host, with its secrets redacted by
+// the redactor. It's meant for append-only audit logs.
+func WriteAudit(w io.Writer, network string, res Result, redactor *Redactor) error {
+	b, err := json.Marshal(auditRecord{
+		Time:     res.End,
+		Network:  network,
+		Host:     res.Host,
+		Command:  res.Command,
+		Resolved: string(redactor.Redact([]byte(res.Resolved))),
+		ExitCode: res.ExitCode,
+		Ignored:  res.Ignored,
+		Duration: res.End.Sub(res.Start).Seconds(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
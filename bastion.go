@@ -0,0 +1,127 @@
+package sup
+
+import (
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// bastion returns the jump host to connect to the host through, if any.
+func (n Network) bastion(host string) string {
+	if bastion, ok := n.HostBastion[host]; ok {
+		return bastion
+	}
+	return n.Bastion
+}
+
+// bastionPool connects to each bastion lazily, once, and shares the
+// connection among all the hosts jumping through it.
+type bastionPool struct {
+	mu    sync.Mutex
+	conns map[string]*bastionConn
+	new   func() *SSHClient
+}
+
+type bastionConn struct {
+	once   sync.Once
+	client *SSHClient
+	err    error
+}
+
+func newBastionPool(new func() *SSHClient) *bastionPool {
+	return &bastionPool{
+		conns: map[string]*bastionConn{},
+		new:   new,
+	}
+}
+
+// get returns the client connected to the bastion, connecting to it on
+// the first call.
+func (p *bastionPool) get(bastion string) (*SSHClient, error) {
+	p.mu.Lock()
+	conn, ok := p.conns[bastion]
+	if !ok {
+		conn = &bastionConn{}
+		p.conns[bastion] = conn
+	}
+	p.mu.Unlock()
+
+	conn.once.Do(func() {
+		client := p.new()
+		if err := client.Connect(bastion); err != nil {
+			conn.err = errors.Wrapf(err, "connecting to bastion %v failed", bastion)
+			return
+		}
+		conn.client = client
+	})
+	return conn.client, conn.err
+}
+
+// close closes the connections to the bastions.
+func (p *bastionPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, conn := range p.conns {
+		if conn.client != nil {
+			conn.client.Close()
+		}
+	}
+	p.conns = map[string]*bastionConn{}
+}
+
+// bastionPool returns the pool of bastions shared by the clients connected
+// until closeBastions, creating it by new clients of the first call.
+func (sup *Stackup) bastionPool(new func() *SSHClient) *bastionPool {
+	sup.bastionsMu.Lock()
+	defer sup.bastionsMu.Unlock()
+	if sup.bastions == nil {
+		sup.bastions = newBastionPool(new)
+	}
+	return sup.bastions
+}
+
+// closeBastions closes the connections to the bastions, once the clients
+// connected through them are closed.
+func (sup *Stackup) closeBastions() {
+	sup.bastionsMu.Lock()
+	defer sup.bastionsMu.Unlock()
+	if sup.bastions != nil {
+		sup.bastions.close()
+		sup.bastions = nil
+	}
+}
+
+// connectBastion connects to the network's bastion as a client of its own,
+// to run commands on the bastion itself.
+func (sup *Stackup) connectBastion(network *Network, env string) (*SSHClient, error) {
+	if network.Bastion == "" {
+		return nil, errors.New("network has no bastion")
+	}
+	sshConfig, err := NewSSHConfig(network.Ciphers, network.KeyExchanges, network.MACs)
+	if err != nil {
+		return nil, errors.Wrap(err, "configuring SSH algorithms failed")
+	}
+	hostKeyCallback, err := NewHostKeyCallback(network.InsecureIgnoreHostKey)
+	if err != nil {
+		return nil, err
+	}
+
+	if sup.noEnv {
+		env = ""
+	} else {
+		env += `export SUP_HOST="` + network.Bastion + `";`
+	}
+	bastion := &SSHClient{
+		env:             env,
+		color:           sup.color(network.Bastion),
+		config:          sshConfig,
+		identityFile:    network.BastionIdentityFile,
+		noAgent:         network.BastionNoAgent,
+		password:        sup.password,
+		hostKeyCallback: hostKeyCallback,
+	}
+	if err := bastion.Connect(network.Bastion); err != nil {
+		return nil, errors.Wrap(err, "connecting to bastion failed")
+	}
+	return bastion, nil
+}
@@ -0,0 +1,41 @@
+package sup
+
+import "os"
+
+// CancelHost aborts the command running on the host, while the other
+// hosts continue. The host is skipped by the subsequent commands of the
+// run. Its result is reported as Cancelled, not as a failure.
+func (sup *Stackup) CancelHost(host string) {
+	sup.runningMu.Lock()
+	defer sup.runningMu.Unlock()
+
+	if sup.cancelled == nil {
+		sup.cancelled = map[string]bool{}
+	}
+	sup.cancelled[hostKey(host)] = true
+
+	for c := range sup.running {
+		if hostKey(clientHost(c)) == hostKey(host) {
+			c.Signal(os.Interrupt)
+			c.Close()
+		}
+	}
+}
+
+// isCancelled reports whether the client's host was cancelled.
+func (sup *Stackup) isCancelled(c Client) bool {
+	sup.runningMu.Lock()
+	defer sup.runningMu.Unlock()
+	return sup.cancelled[hostKey(clientHost(c))]
+}
+
+// activeClients returns the clients of the hosts that weren't cancelled.
+func (sup *Stackup) activeClients(clients []Client) []Client {
+	var active []Client
+	for _, c := range clients {
+		if !sup.isCancelled(c) {
+			active = append(active, c)
+		}
+	}
+	return active
+}
@@ -0,0 +1,129 @@
+package sup
+
+import (
+	"archive/tar"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// uploadChecksum returns the checksum of the names, modes and contents of
+// the files uploaded from the path. Unlike the tar stream, it doesn't
+// change with the modification times, ie. of a fresh git checkout.
+func uploadChecksum(tarCommand, cwd, path string, excludes, anchored []string) (string, error) {
+	r, err := newTarStreamReader(tarCommand, cwd, path, excludes, anchored, "none")
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", errors.Wrap(err, "reading tar stream failed")
+		}
+		fmt.Fprintf(hash, "%v\x00%o\x00%c\x00%v\x00", hdr.Name, hdr.Mode, hdr.Typeflag, hdr.Linkname)
+		if _, err := io.Copy(hash, tr); err != nil {
+			return "", errors.Wrap(err, "reading tar stream failed")
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// uploadStatePath returns the file keeping the checksum of the named upload
+// last extracted to the dst on the host.
+func uploadStatePath(name, dst string) string {
+	sum := sha1.Sum([]byte(name + "\x00" + dst))
+	return "$HOME/.cache/sup/uploads/" + hex.EncodeToString(sum[:])
+}
+
+// detectChanges reads the checksum of the named upload last extracted on
+// each of the clients, and records which of them the upload changes.
+func (sup *Stackup) detectChanges(name string, clients []Client, shell, state, checksum string) {
+	changed := make([]bool, len(clients))
+	var wg sync.WaitGroup
+	for i, c := range clients {
+		wg.Add(1)
+		go func(i int, c Client) {
+			defer wg.Done()
+			changed[i] = true
+			task := &Task{
+				Run:     "cat " + doubleQuote(state) + " 2>/dev/null || true",
+				Clients: []Client{c},
+				Shell:   shell,
+			}
+			stdout, err := runCapture(c, task)
+			if err == nil {
+				changed[i] = strings.TrimSpace(stdout) != checksum
+			}
+		}(i, c)
+	}
+	wg.Wait()
+
+	sup.changedMu.Lock()
+	defer sup.changedMu.Unlock()
+	if sup.changed == nil {
+		sup.changed = map[string]map[string]bool{}
+	}
+	if sup.changed[name] == nil {
+		sup.changed[name] = map[string]bool{}
+	}
+	for i, c := range clients {
+		sup.changed[name][clientHost(c)] = changed[i]
+	}
+}
+
+// recordChecksum returns the command saving the checksum of the upload on
+// the host, once it's extracted.
+func recordChecksum(state, checksum string) string {
+	return fmt.Sprintf(" && mkdir -p \"$(dirname %s)\" && echo %s > %s", doubleQuote(state), checksum, doubleQuote(state))
+}
+
+// changedClients returns the clients the command's run_if_changed upload
+// changed, or didn't run on, and reports the others as unchanged.
+func (sup *Stackup) changedClients(cmd *Command, clients []Client) []Client {
+	sup.changedMu.Lock()
+	changed, ok := sup.changed[cmd.RunIfChanged]
+	sup.changedMu.Unlock()
+	if !ok {
+		sup.log(LogEntry{
+			Level:   LogWarn,
+			Message: fmt.Sprintf("%v: upload %v didn't run before, running on all hosts", cmd.Name, cmd.RunIfChanged),
+			Command: cmd.Name,
+		})
+		return clients
+	}
+
+	var run []Client
+	for _, c := range clients {
+		if isChanged, ok := changed[clientHost(c)]; ok && !isChanged {
+			now := time.Now()
+			sup.result(Result{
+				Host:      clientHost(c),
+				Command:   cmd.Name,
+				Start:     now,
+				End:       now,
+				Unchanged: true,
+			})
+			sup.log(LogEntry{
+				Level:   LogInfo,
+				Message: fmt.Sprintf("%v: skipped on %v, upload %v didn't change anything", cmd.Name, clientHost(c), cmd.RunIfChanged),
+				Host:    clientHost(c),
+				Command: cmd.Name,
+			})
+			continue
+		}
+		run = append(run, c)
+	}
+	return run
+}
@@ -3,6 +3,8 @@ package sup
 import (
 	"io"
 	"os"
+	"regexp"
+	"strings"
 )
 
 type Client interface {
@@ -18,3 +20,39 @@ type Client interface {
 	Stdout() io.Reader
 	Signal(os.Signal) error
 }
+
+// HostClient is a Client reporting the host it's connected to, as given
+// to Connect. The results, logs and hooks refer to the host by it.
+type HostClient interface {
+	Client
+	Host() string
+}
+
+// CommandClient is a Client reporting the final command string last
+// started by Run, recorded in the results and the audit log.
+type CommandClient interface {
+	Client
+	Command() string
+}
+
+// colorCode matches the color codes of the prefixes, see colorize.
+var colorCode = regexp.MustCompile("\033\\[[0-9;]*m")
+
+// clientHost returns the host of the client, see HostClient. The clients
+// not reporting their host are referred to by their prefix.
+func clientHost(c Client) string {
+	if c, ok := c.(HostClient); ok {
+		return c.Host()
+	}
+	prefix, _ := c.Prefix()
+	return strings.TrimSuffix(colorCode.ReplaceAllString(prefix, ""), " | ")
+}
+
+// clientCommand returns the command last run by the client, see
+// CommandClient, or an empty string, if it doesn't report it.
+func clientCommand(c Client) string {
+	if c, ok := c.(CommandClient); ok {
+		return c.Command()
+	}
+	return ""
+}
@@ -1,41 +1,93 @@
 package main
 
 import (
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"os/user"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	runtimedebug "runtime/debug"
+	"strconv"
 	"strings"
 	"text/tabwriter"
 	"time"
 
-	"github.com/mikkeloscar/sshconfig"
 	"github.com/pkg/errors"
 	"github.com/pressly/sup"
+	"golang.org/x/crypto/ssh/terminal"
 )
 
 var (
-	supfile     string
-	envVars     flagStringSlice
-	sshConfig   string
-	onlyHosts   string
-	exceptHosts string
+	supfiles       flagStringSlice
+	chdir          string
+	envVars        flagStringSlice
+	sshConfig      string
+	onlyHosts      string
+	onlyExactHosts string
+	exceptHosts    string
+	filterBy       string
+	unknownCmds    string
+	reverse        bool
+	adhocHosts     string
+	inventoryFile  string
+	metricsFile    string
+	supTime        string
+	auditLog       string
+	archiveLog     string
+	notifyURL      string
+	notifyFormat   string
+	notifyTemplate string
+
+	sshCiphers      string
+	sshKeyExchanges string
+	sshMACs         string
+
+	insecureIgnoreHostKey bool
+	askPass               bool
 
 	debug         bool
+	verbose       bool
 	disablePrefix bool
+	raw           bool
+	mergeStderr   bool
+	noTTY         bool
+	noEnv         bool
+	forks         int
+	connectForks  int
+	port          int
+	deadline      time.Duration
+
+	interactiveShell bool
+	gatherFacts      bool
+	ping             bool
+	printStatus      bool
+
+	tags     string
+	skipTags string
 
 	showVersion bool
+	list        bool
+	output      string
 	showHelp    bool
 
-	ErrUsage            = errors.New("Usage: sup [OPTIONS] NETWORK COMMAND [...]\n       sup [ --help | -v | --version ]")
+	ErrUsage            = errors.New("Usage: sup [OPTIONS] NETWORK COMMAND [...] [-- INLINE COMMAND]\n       sup [OPTIONS] --hosts HOST[,...] COMMAND [...] [-- INLINE COMMAND]\n       sup [OPTIONS] --shell NETWORK\n       sup [OPTIONS] --facts NETWORK\n       sup [OPTIONS] --ping NETWORK\n       sup [ --help | -v | --version ]")
 	ErrUnknownNetwork   = errors.New("Unknown network")
 	ErrNetworkNoHosts   = errors.New("No hosts defined for a given network")
 	ErrCmd              = errors.New("Unknown command/target")
+	ErrCmdNetwork       = errors.New("Command not available on a given network")
 	ErrTargetNoCommands = errors.New("No commands defined for a given target")
 	ErrConfigFile       = errors.New("Unknown ssh_config file")
+	ErrSupfileNotFound  = errors.New("Supfile not found in current directory, its parents or ~/.config/sup")
+	ErrShellCommands    = errors.New("--shell reads commands from STDIN, don't pass any on the command line")
+	ErrFactsCommands    = errors.New("--facts gathers facts instead of running commands, don't pass any on the command line")
+	ErrPingCommands     = errors.New("--ping only connects to the hosts, don't pass any commands on the command line")
+	ErrNoTaggedCommands = errors.New("No commands match --tags and --skip-tags")
+	ErrAskPassNoTTY     = errors.New("Can't prompt for the SSH password, STDIN is not a terminal; set SUP_SSH_PASSWORD instead")
 )
 
 type flagStringSlice []string
@@ -50,33 +102,70 @@ func (f *flagStringSlice) Set(value string) error {
 }
 
 func init() {
-	flag.StringVar(&supfile, "f", "", "Custom path to ./Supfile[.yml]")
+	flag.Var(&supfiles, "f", "Custom path to ./Supfile[.yml|.json], repeat to merge several Supfiles in order")
+	flag.StringVar(&chdir, "chdir", "", "Resolve relative paths, including -f, from the directory (default $SUP_CONFIG_DIR)")
 	flag.Var(&envVars, "e", "Set environment variables")
 	flag.Var(&envVars, "env", "Set environment variables")
+	flag.StringVar(&inventoryFile, "inventory-file", "", "Read hosts from Ansible-style INI inventory file")
 	flag.StringVar(&sshConfig, "sshconfig", "", "Read SSH Config file, ie. ~/.ssh/config file")
-	flag.StringVar(&onlyHosts, "only", "", "Filter hosts using regexp")
-	flag.StringVar(&exceptHosts, "except", "", "Filter out hosts using regexp")
+	flag.StringVar(&sshCiphers, "ciphers", "", "Comma-separated list of allowed SSH ciphers")
+	flag.StringVar(&sshKeyExchanges, "kex", "", "Comma-separated list of allowed SSH key exchange algorithms")
+	flag.StringVar(&sshMACs, "macs", "", "Comma-separated list of allowed SSH MAC algorithms")
+	flag.BoolVar(&insecureIgnoreHostKey, "insecure-ignore-host-key", false, "Don't verify host keys against ~/.ssh/known_hosts")
+	flag.BoolVar(&askPass, "ask-pass", false, "Prompt for the SSH password once and use it for all hosts")
+	flag.StringVar(&onlyHosts, "only", "", "Filter hosts using RE2 regexp")
+	flag.IntVar(&port, "port", 0, "SSH port of hosts without one (default 22)")
+	flag.StringVar(&adhocHosts, "hosts", "", "Run on comma-separated list of hosts instead of a network")
+	flag.StringVar(&onlyExactHosts, "only-exact", "", "Filter hosts using comma-separated list of exact host names")
+	flag.StringVar(&exceptHosts, "except", "", "Filter out hosts using RE2 regexp")
+	flag.BoolVar(&reverse, "reverse", false, "Run on the hosts in reverse order, ie. serial batches and once commands start from the last host")
+	flag.StringVar(&filterBy, "filter-by", "alias", "Match --only, --only-exact and --except against the host as listed, its ssh_config HostName, or either (alias|hostname|any)")
 
 	flag.BoolVar(&debug, "D", false, "Enable debug mode")
 	flag.BoolVar(&debug, "debug", false, "Enable debug mode")
+	flag.BoolVar(&verbose, "verbose", false, "Print hosts matching filters before running")
 	flag.BoolVar(&disablePrefix, "disable-prefix", false, "Disable hostname prefix")
+	flag.BoolVar(&raw, "raw", false, "Stream raw output, without hostname prefix and line buffering")
+	flag.IntVar(&forks, "forks", 0, "Max number of hosts to run a command on simultaneously (0 = no limit)")
+	flag.IntVar(&connectForks, "connect-forks", 0, "Max number of hosts to connect to simultaneously (0 = no limit)")
+	flag.DurationVar(&deadline, "deadline", 0, "Abort the run, if it takes longer than the duration, ie. 15m")
+	flag.BoolVar(&mergeStderr, "merge-stderr", false, "Redirect STDERR of commands to STDOUT, keeping the order of output lines")
+	flag.BoolVar(&noTTY, "no-tty", false, "Disable pseudo terminal for all commands")
+	flag.BoolVar(&noEnv, "no-env", false, "Run commands without exporting any env vars, including $SUP_HOST and the others")
+	flag.StringVar(&unknownCmds, "unknown-commands", "strict", "Fail on unknown commands/targets, skip them with a warning, or run the unknown args as remote commands (strict|skip|run)")
+	flag.StringVar(&tags, "tags", "", "Run only commands tagged by any of comma-separated tags")
+	flag.StringVar(&skipTags, "skip-tags", "", "Skip commands tagged by any of comma-separated tags")
+	flag.BoolVar(&interactiveShell, "shell", false, "Connect once and run commands typed on STDIN on all hosts")
+	flag.BoolVar(&gatherFacts, "facts", false, "Print facts about the hosts, ie. OS, kernel and arch, instead of running commands")
+	flag.BoolVar(&ping, "ping", false, "Connect to all the hosts and report the unreachable ones, instead of running commands")
 
+	flag.BoolVar(&list, "list", false, "Print networks, or commands available on the given network, to STDOUT")
 	flag.BoolVar(&showVersion, "v", false, "Print version")
 	flag.BoolVar(&showVersion, "version", false, "Print version")
+	flag.StringVar(&supTime, "time", "", "Set $SUP_TIME, ie. to re-run a deploy into the same release directory")
+	flag.StringVar(&metricsFile, "metrics-file", "", "Write Prometheus metrics of the run to a file")
+	flag.StringVar(&archiveLog, "archive-log", "", "Write output of all hosts, Supfile, env and summary of the run to a .tar.gz file")
+	flag.StringVar(&notifyURL, "notify-url", "", "POST a summary of the run to the webhook URL")
+	flag.StringVar(&notifyFormat, "notify-format", "json", "Payload of --notify-url (json|slack)")
+	flag.StringVar(&notifyTemplate, "notify-template", "", "Go text/template of the --notify-url message")
+	flag.StringVar(&auditLog, "audit-log", "", "Append the exact command run on each host to a JSON lines file")
+	flag.BoolVar(&printStatus, "print-status", false, "Print SUP-STATUS line with exit code of each host to STDOUT after each command")
+	flag.StringVar(&output, "output", "text", "Output format of --version, --facts and --ping (text|json)")
 	flag.BoolVar(&showHelp, "h", false, "Show help")
 	flag.BoolVar(&showHelp, "help", false, "Show help")
 }
 
-func networkUsage(conf *sup.Supfile) {
+// networkUsage prints networks and their hosts.
+func networkUsage(out io.Writer, conf *sup.Supfile) {
 	w := &tabwriter.Writer{}
-	w.Init(os.Stderr, 4, 4, 2, ' ', 0)
+	w.Init(out, 4, 4, 2, ' ', 0)
 	defer w.Flush()
 
 	// Print available networks/hosts.
 	fmt.Fprintln(w, "Networks:\t")
 	for _, name := range conf.Networks.Names {
-		fmt.Fprintf(w, "- %v\n", name)
 		network, _ := conf.Networks.Get(name)
+		fmt.Fprintf(w, "- %v\t%v\n", name, network.Desc)
 		for _, host := range network.Hosts {
 			fmt.Fprintf(w, "\t- %v\n", host)
 		}
@@ -84,9 +173,30 @@ func networkUsage(conf *sup.Supfile) {
 	fmt.Fprintln(w)
 }
 
-func cmdUsage(conf *sup.Supfile) {
+// selectedByTags reports whether the command passes the --tags and
+// --skip-tags filters.
+func selectedByTags(cmd sup.Command) bool {
+	hasAny := func(list string) bool {
+		for _, tag := range strings.Split(list, ",") {
+			if cmd.HasTag(strings.TrimSpace(tag)) {
+				return true
+			}
+		}
+		return false
+	}
+	if tags != "" && !hasAny(tags) {
+		return false
+	}
+	if skipTags != "" && hasAny(skipTags) {
+		return false
+	}
+	return true
+}
+
+// cmdUsage prints targets/commands available on the given network.
+func cmdUsage(out io.Writer, conf *sup.Supfile, network string) {
 	w := &tabwriter.Writer{}
-	w.Init(os.Stderr, 4, 4, 2, ' ', 0)
+	w.Init(out, 4, 4, 2, ' ', 0)
 	defer w.Flush()
 
 	// Print available targets/commands.
@@ -99,6 +209,9 @@ func cmdUsage(conf *sup.Supfile) {
 	fmt.Fprintln(w, "Commands:\t")
 	for _, name := range conf.Commands.Names {
 		cmd, _ := conf.Commands.Get(name)
+		if !cmd.AvailableOn(network) {
+			continue
+		}
 		fmt.Fprintf(w, "- %v\t%v\n", name, cmd.Desc)
 	}
 	fmt.Fprintln(w)
@@ -109,50 +222,103 @@ func cmdUsage(conf *sup.Supfile) {
 func parseArgs(conf *sup.Supfile) (*sup.Network, []*sup.Command, error) {
 	var commands []*sup.Command
 
-	args := flag.Args()
-	if len(args) < 1 {
-		networkUsage(conf)
-		return nil, nil, ErrUsage
-	}
+	var (
+		args, inline = splitInlineCommand(flag.Args())
+		network      sup.Network
+		networkName  string
+	)
+	if adhocHosts != "" {
+		// Ad-hoc network of hosts given by --hosts flag. All args are commands.
+		for _, host := range strings.Split(adhocHosts, ",") {
+			if host = strings.TrimSpace(host); host != "" {
+				network.Hosts = append(network.Hosts, host)
+			}
+		}
+	} else {
+		// Supfile's default network, if none is given.
+		if len(args) < 1 && conf.DefaultNetwork != "" {
+			args = []string{conf.DefaultNetwork}
+		}
+		if len(args) < 1 {
+			networkUsage(os.Stderr, conf)
+			return nil, nil, ErrUsage
+		}
 
-	// Does the <network> exist?
-	network, ok := conf.Networks.Get(args[0])
-	if !ok {
-		networkUsage(conf)
-		return nil, nil, ErrUnknownNetwork
+		// Does the <network> exist?
+		var ok bool
+		networkName, args = args[0], args[1:]
+		network, ok = conf.Networks.Get(networkName)
+		if !ok {
+			networkUsage(os.Stderr, conf)
+			return nil, nil, ErrUnknownNetwork
+		}
 	}
 
-	// Parse CLI --env flag env vars, override values defined in Network env.
+	// Parse CLI --env flag env vars, override values defined in Network env
+	// and hosts' env. The env vars are copied first, they're shared with
+	// the network of the Supfile.
+	network.Env = network.Env.Copy()
+	if network.HostEnv != nil {
+		hostEnvs := make(map[string]sup.EnvList, len(network.HostEnv))
+		for host, hostEnv := range network.HostEnv {
+			hostEnvs[host] = hostEnv.Copy()
+		}
+		network.HostEnv = hostEnvs
+	}
 	for _, env := range envVars {
 		if len(env) == 0 {
 			continue
 		}
-		i := strings.Index(env, "=")
-		if i < 0 {
-			if len(env) > 0 {
-				network.Env.Set(env, "")
+		key, value := env, ""
+		if i := strings.Index(env, "="); i >= 0 {
+			key, value = env[:i], env[i+1:]
+		}
+		network.Env.Set(key, value)
+		for _, hostEnv := range network.HostEnv {
+			for _, v := range hostEnv {
+				if v.Key == key {
+					v.Value = value
+				}
 			}
-			continue
 		}
-		network.Env.Set(env[:i], env[i+1:])
 	}
 
-	hosts, err := network.ParseInventory()
+	// --inventory-file flag overrides network's inventory file.
+	if inventoryFile != "" {
+		network.InventoryFile = resolvePath(inventoryFile)
+	}
+	hosts, err := network.ResolveHosts()
 	if err != nil {
 		return nil, nil, err
 	}
-	network.Hosts = append(network.Hosts, hosts...)
+	network.Hosts = hosts
 
 	// Does the <network> have at least one host?
 	if len(network.Hosts) == 0 {
-		networkUsage(conf)
+		networkUsage(os.Stderr, conf)
 		return nil, nil, ErrNetworkNoHosts
 	}
 
-	// Check for the second argument
-	if len(args) < 2 {
-		cmdUsage(conf)
-		return nil, nil, ErrUsage
+	// Check for the command argument
+	if interactiveShell {
+		if len(args) > 0 || inline != "" {
+			return nil, nil, ErrShellCommands
+		}
+	} else if gatherFacts {
+		if len(args) > 0 || inline != "" {
+			return nil, nil, ErrFactsCommands
+		}
+	} else if ping {
+		if len(args) > 0 || inline != "" {
+			return nil, nil, ErrPingCommands
+		}
+	} else if len(args) < 1 && inline == "" && tags == "" {
+		// Supfile's default command or target, if none is given.
+		if conf.DefaultCommand == "" {
+			cmdUsage(os.Stderr, conf, networkName)
+			return nil, nil, ErrUsage
+		}
+		args = []string{conf.DefaultCommand}
 	}
 
 	// In case of the network.Env needs an initialization
@@ -161,13 +327,16 @@ func parseArgs(conf *sup.Supfile) (*sup.Network, []*sup.Command, error) {
 	}
 
 	// Add default env variable with current network
-	network.Env.Set("SUP_NETWORK", args[0])
+	network.Env.Set("SUP_NETWORK", networkName)
 
-	// Add default nonce
+	// Add default nonce, overridden by SUP_TIME env var and --time flag
 	network.Env.Set("SUP_TIME", time.Now().UTC().Format(time.RFC3339))
 	if os.Getenv("SUP_TIME") != "" {
 		network.Env.Set("SUP_TIME", os.Getenv("SUP_TIME"))
 	}
+	if supTime != "" {
+		network.Env.Set("SUP_TIME", supTime)
+	}
 
 	// Add user
 	if os.Getenv("SUP_USER") != "" {
@@ -176,18 +345,39 @@ func parseArgs(conf *sup.Supfile) (*sup.Network, []*sup.Command, error) {
 		network.Env.Set("SUP_USER", os.Getenv("USER"))
 	}
 
-	for _, cmd := range args[1:] {
+	// --unknown-commands flag relaxes the command/target lookup, ie. to use
+	// a Supfile of a newer sup.
+	switch unknownCmds {
+	case "strict", "skip", "run":
+	default:
+		return nil, nil, fmt.Errorf("--unknown-commands: unknown %q, expected strict, skip or run", unknownCmds)
+	}
+
+	for _, cmd := range args {
 		// Target?
-		target, isTarget := conf.Targets.Get(cmd)
+		_, isTarget := conf.Targets.Get(cmd)
 		if isTarget {
+			targetCmds, err := conf.ExpandTarget(cmd)
+			if e, ok := err.(sup.ErrUnknownCommands); ok && unknownCmds != "strict" {
+				for _, name := range e.Commands {
+					fmt.Fprintf(os.Stderr, "Skipping unknown command %v (referenced by target %v)\n", name, cmd)
+				}
+				err = nil
+			}
+			if err != nil {
+				cmdUsage(os.Stderr, conf, networkName)
+				return nil, nil, err
+			}
 			// Loop over target's commands.
-			for _, cmd := range target {
-				command, isCommand := conf.Commands.Get(cmd)
-				if !isCommand {
-					cmdUsage(conf)
-					return nil, nil, fmt.Errorf("%v: %v", ErrCmd, cmd)
+			for _, command := range targetCmds {
+				command := command
+				if !selectedByTags(command) {
+					continue
+				}
+				if !command.AvailableOn(networkName) {
+					cmdUsage(os.Stderr, conf, networkName)
+					return nil, nil, fmt.Errorf("%v: %v", ErrCmdNetwork, command.Name)
 				}
-				command.Name = cmd
 				commands = append(commands, &command)
 			}
 		}
@@ -195,24 +385,254 @@ func parseArgs(conf *sup.Supfile) (*sup.Network, []*sup.Command, error) {
 		// Command?
 		command, isCommand := conf.Commands.Get(cmd)
 		if isCommand {
+			if !command.AvailableOn(networkName) {
+				cmdUsage(os.Stderr, conf, networkName)
+				return nil, nil, fmt.Errorf("%v: %v", ErrCmdNetwork, cmd)
+			}
 			command.Name = cmd
 			commands = append(commands, &command)
 		}
 
 		if !isTarget && !isCommand {
-			cmdUsage(conf)
+			switch unknownCmds {
+			case "skip":
+				fmt.Fprintf(os.Stderr, "Skipping unknown command/target %v\n", cmd)
+				continue
+			case "run":
+				// Literal remote command, like the inline one.
+				commands = append(commands, &sup.Command{
+					Name: cmd,
+					Run:  cmd,
+				})
+				continue
+			}
+			cmdUsage(os.Stderr, conf, networkName)
 			return nil, nil, fmt.Errorf("%v: %v", ErrCmd, cmd)
 		}
 	}
 
+	// --tags flag with no commands given selects all the tagged commands.
+	if len(args) == 0 && inline == "" && tags != "" {
+		for _, name := range conf.Commands.Names {
+			command, _ := conf.Commands.Get(name)
+			if selectedByTags(command) && command.AvailableOn(networkName) {
+				command.Name = name
+				commands = append(commands, &command)
+			}
+		}
+	}
+	if (tags != "" || skipTags != "") && len(commands) == 0 && inline == "" {
+		return nil, nil, ErrNoTaggedCommands
+	}
+
+	// Inline command given after the "--" separator.
+	if inline != "" {
+		commands = append(commands, &sup.Command{
+			Name: inline,
+			Run:  inline,
+		})
+	}
+
 	return &network, commands, nil
 }
 
+// splitInlineCommand splits args into args preceding the "--" separator
+// and an inline command made of the args following it.
+func splitInlineCommand(args []string) ([]string, string) {
+	for i, arg := range args {
+		if arg == "--" {
+			return args[:i], strings.Join(args[i+1:], " ")
+		}
+	}
+
+	// The flag pkg consumes "--" if there are no args preceding it,
+	// ie. `sup --hosts host1 -- uptime`. Look it up in the raw args.
+	for i, arg := range os.Args[1:] {
+		if arg == "--" {
+			n := len(os.Args) - 2 - i
+			if n > len(args) {
+				n = len(args)
+			}
+			return args[:len(args)-n], strings.Join(args[len(args)-n:], " ")
+		}
+	}
+
+	return args, ""
+}
+
+// versionInfo describes the sup binary.
+type versionInfo struct {
+	Version string `json:"version"`
+	Go      string `json:"go"`
+	Commit  string `json:"commit,omitempty"`
+	OS      string `json:"os"`
+	Arch    string `json:"arch"`
+}
+
+// printVersion prints version and build info. In the text format,
+// the plain version is printed on the first line.
+func printVersion(format string) error {
+	info := versionInfo{
+		Version: sup.VERSION,
+		Go:      runtime.Version(),
+		OS:      runtime.GOOS,
+		Arch:    runtime.GOARCH,
+	}
+	if build, ok := runtimedebug.ReadBuildInfo(); ok {
+		for _, setting := range build.Settings {
+			if setting.Key == "vcs.revision" {
+				info.Commit = setting.Value
+			}
+		}
+	}
+
+	switch format {
+	case "json":
+		// STDOUT, so it can be piped to tooling, ie. jq.
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(info)
+	case "text", "":
+		fmt.Fprintln(os.Stderr, info.Version)
+		fmt.Fprintf(os.Stderr, "go: %v\n", info.Go)
+		if info.Commit != "" {
+			fmt.Fprintf(os.Stderr, "commit: %v\n", info.Commit)
+		}
+		fmt.Fprintf(os.Stderr, "os/arch: %v/%v\n", info.OS, info.Arch)
+		return nil
+	default:
+		return fmt.Errorf("unknown output format %q", format)
+	}
+}
+
+// statusValue quotes the value of a SUP-STATUS field, if it contains
+// spaces or quotes, so the line splits on spaces.
+func statusValue(value string) string {
+	if value == "" || strings.ContainsAny(value, " \t\"") {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+// printFacts prints the facts of the hosts as a table, or as JSON keyed
+// by host. Hosts that failed get their error instead of the facts.
+func printFacts(w io.Writer, format string, facts []sup.Fact, hostFacts []sup.HostFacts) error {
+	switch format {
+	case "json":
+		hosts := map[string]map[string]string{}
+		for _, hf := range hostFacts {
+			if hf.Err != nil {
+				hosts[hf.Host] = map[string]string{"error": hf.Err.Error()}
+				continue
+			}
+			hosts[hf.Host] = hf.Facts
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(hosts)
+	case "text", "":
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprint(tw, "HOST")
+		for _, fact := range facts {
+			fmt.Fprintf(tw, "\t%v", strings.ToUpper(fact.Name))
+		}
+		fmt.Fprintln(tw)
+		for _, hf := range hostFacts {
+			fmt.Fprint(tw, hf.Host)
+			if hf.Err != nil {
+				fmt.Fprintf(tw, "\t%v\n", hf.Err)
+				continue
+			}
+			for _, fact := range facts {
+				fmt.Fprintf(tw, "\t%v", hf.Facts[fact.Name])
+			}
+			fmt.Fprintln(tw)
+		}
+		return tw.Flush()
+	default:
+		return fmt.Errorf("unknown output format %q", format)
+	}
+}
+
+// printPings prints reachability of the hosts as a table, or as JSON
+// keyed by host.
+func printPings(w io.Writer, format string, pings []sup.HostPing) error {
+	switch format {
+	case "json":
+		type hostPing struct {
+			Reachable bool   `json:"reachable"`
+			Error     string `json:"error,omitempty"`
+		}
+		hosts := map[string]hostPing{}
+		for _, p := range pings {
+			hp := hostPing{Reachable: p.Err == nil}
+			if p.Err != nil {
+				hp.Error = p.Err.Error()
+			}
+			hosts[p.Host] = hp
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(hosts)
+	case "text", "":
+		tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "HOST\tSTATUS\tERROR")
+		for _, p := range pings {
+			if p.Err != nil {
+				fmt.Fprintf(tw, "%v\tunreachable\t%v\n", p.Host, p.Err)
+				continue
+			}
+			fmt.Fprintf(tw, "%v\treachable\t\n", p.Host)
+		}
+		return tw.Flush()
+	default:
+		return fmt.Errorf("unknown output format %q", format)
+	}
+}
+
+// supfileNames are the file names looked up in each directory, in order.
+var supfileNames = []string{"Supfile", "Supfile.yml", "Supfile.json"}
+
+// findSupfile looks up Supfile in the current directory and its parents
+// (like git looks up .git), then in $XDG_CONFIG_HOME/sup (~/.config/sup).
+// It returns an empty path if there's no Supfile and reports whether
+// the Supfile was found in a parent directory.
+func findSupfile() (path string, inParentDir bool) {
+	cwd, err := os.Getwd()
+	if err == nil {
+		for dir := cwd; ; dir = filepath.Dir(dir) {
+			if path := lookupSupfile(dir); path != "" {
+				return path, dir != cwd
+			}
+			if dir == filepath.Dir(dir) { // Root.
+				break
+			}
+		}
+	}
+
+	configDir := os.Getenv("XDG_CONFIG_HOME")
+	if configDir == "" {
+		configDir = resolvePath("~/.config")
+	}
+	return lookupSupfile(filepath.Join(configDir, "sup")), false
+}
+
+// lookupSupfile returns path to Supfile in the given directory, if any.
+func lookupSupfile(dir string) string {
+	for _, name := range supfileNames {
+		path := filepath.Join(dir, name)
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			return path
+		}
+	}
+	return ""
+}
+
 func resolvePath(path string) string {
 	if path == "" {
 		return ""
 	}
-	if path[:2] == "~/" {
+	if strings.HasPrefix(path, "~/") {
 		usr, err := user.Current()
 		if err == nil {
 			path = filepath.Join(usr.HomeDir, path[2:])
@@ -231,29 +651,64 @@ func main() {
 	}
 
 	if showVersion {
-		fmt.Fprintln(os.Stderr, sup.VERSION)
+		if err := printVersion(output); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
 		return
 	}
 
-	if supfile == "" {
-		supfile = "./Supfile"
+	// --chdir flag, or SUP_CONFIG_DIR env var, sets the base directory
+	// of relative local paths, ie. scripts and uploads, instead of CWD.
+	if chdir == "" {
+		chdir = os.Getenv("SUP_CONFIG_DIR")
 	}
-	data, err := ioutil.ReadFile(resolvePath(supfile))
-	if err != nil {
-		firstErr := err
-		data, err = ioutil.ReadFile("./Supfile.yml") // Alternative to ./Supfile.
-		if err != nil {
-			fmt.Fprintln(os.Stderr, firstErr)
-			fmt.Fprintln(os.Stderr, err)
+	if chdir != "" {
+		if err := os.Chdir(resolvePath(chdir)); err != nil {
+			fmt.Fprintln(os.Stderr, errors.Wrap(err, "--chdir"))
 			os.Exit(1)
 		}
 	}
-	conf, err := sup.NewSupfile(data)
+
+	if len(supfiles) == 0 {
+		supfile, inParentDir := findSupfile()
+		if supfile == "" && adhocHosts == "" {
+			fmt.Fprintln(os.Stderr, ErrSupfileNotFound)
+			os.Exit(1)
+		}
+		// Run from the project root, so relative paths in Supfile work.
+		if inParentDir && chdir == "" {
+			if err := os.Chdir(filepath.Dir(supfile)); err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+		}
+		if supfile != "" {
+			supfiles = append(supfiles, supfile)
+		}
+	}
+	conf, data, err := loadSupfiles(supfiles)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 
+	// --list flag prints networks, or commands of the network, to STDOUT
+	if list {
+		args := flag.Args()
+		if len(args) == 0 {
+			networkUsage(os.Stdout, conf)
+			return
+		}
+		if _, ok := conf.Networks.Get(args[0]); !ok {
+			networkUsage(os.Stderr, conf)
+			fmt.Fprintln(os.Stderr, fmt.Errorf("%v: %v", ErrUnknownNetwork, args[0]))
+			os.Exit(1)
+		}
+		cmdUsage(os.Stdout, conf, args[0])
+		return
+	}
+
 	// Parse network and commands to be run from args.
 	network, commands, err := parseArgs(conf)
 	if err != nil {
@@ -261,18 +716,69 @@ func main() {
 		os.Exit(1)
 	}
 
+	// --sshconfig flag location for ssh_config file
+	var sshHosts *sup.SSHConfig
+	if sshConfig != "" {
+		sshHosts, err = sup.ParseSSHConfig(resolvePath(sshConfig))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	// --notify-format and --notify-template flags are checked before the run,
+	// not once it's over.
+	if err := sup.CheckNotify(notifyFormat, notifyTemplate); err != nil {
+		fmt.Fprintln(os.Stderr, errors.Wrap(err, "--notify-url"))
+		os.Exit(1)
+	}
+
+	// --filter-by flag sets the names of the hosts the filters match against.
+	switch filterBy {
+	case "alias", "hostname", "any":
+	default:
+		fmt.Fprintln(os.Stderr, fmt.Errorf("--filter-by: unknown %q, expected alias, hostname or any", filterBy))
+		os.Exit(1)
+	}
+
+	// The hostname is the bare HostName of the host's ssh_config entry,
+	// without the user and port, or the listed host, if there's none.
+	hostNames := func(host string) []string {
+		hostname := host
+		if _, hostConf, ok := resolveSSHHost(sshHosts, host); ok && hostConf.HostName != "" {
+			hostname = hostConf.HostName
+		}
+		switch filterBy {
+		case "hostname":
+			return []string{hostname}
+		case "any":
+			return []string{host, hostname}
+		}
+		return []string{host}
+	}
+	matchHost := func(expr *regexp.Regexp, host string) bool {
+		for _, name := range hostNames(host) {
+			if expr.MatchString(name) {
+				return true
+			}
+		}
+		return false
+	}
+
 	// --only flag filters hosts
 	if onlyHosts != "" {
-		expr, err := regexp.CompilePOSIX(onlyHosts)
+		expr, err := regexp.Compile(onlyHosts)
 		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
+			fmt.Fprintln(os.Stderr, errors.Wrap(err, "--only: invalid RE2 regexp"))
 			os.Exit(1)
 		}
 
 		var hosts []string
 		for _, host := range network.Hosts {
-			if expr.MatchString(host) {
+			if matchHost(expr, host) {
 				hosts = append(hosts, host)
+			} else {
+				skipHost(host, fmt.Sprintf("doesn't match --only '%v' regexp", onlyHosts))
 			}
 		}
 		if len(hosts) == 0 {
@@ -282,57 +788,139 @@ func main() {
 		network.Hosts = hosts
 	}
 
-	// --except flag filters out hosts
-	if exceptHosts != "" {
-		expr, err := regexp.CompilePOSIX(exceptHosts)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
-			os.Exit(1)
+	// --only-exact flag filters hosts matching exactly
+	if onlyExactHosts != "" {
+		exact := map[string]bool{}
+		for _, host := range strings.Split(onlyExactHosts, ",") {
+			exact[strings.TrimSpace(host)] = true
 		}
 
 		var hosts []string
 		for _, host := range network.Hosts {
-			if !expr.MatchString(host) {
+			listed := false
+			for _, name := range hostNames(host) {
+				listed = listed || exact[name]
+			}
+			if listed {
 				hosts = append(hosts, host)
+			} else {
+				skipHost(host, "not listed in --only-exact")
 			}
 		}
 		if len(hosts) == 0 {
-			fmt.Fprintln(os.Stderr, fmt.Errorf("no hosts left after --except '%v' regexp", onlyHosts))
+			fmt.Fprintln(os.Stderr, fmt.Errorf("no hosts match --only-exact '%v'", onlyExactHosts))
 			os.Exit(1)
 		}
 		network.Hosts = hosts
 	}
 
-	// --sshconfig flag location for ssh_config file
-	if sshConfig != "" {
-		confHosts, err := sshconfig.ParseSSHConfig(resolvePath(sshConfig))
+	// --except flag filters out hosts
+	if exceptHosts != "" {
+		expr, err := regexp.Compile(exceptHosts)
 		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
+			fmt.Fprintln(os.Stderr, errors.Wrap(err, "--except: invalid RE2 regexp"))
 			os.Exit(1)
 		}
 
-		// flatten Host -> *SSHHost, not the prettiest
-		// but will do
-		confMap := map[string]*sshconfig.SSHHost{}
-		for _, conf := range confHosts {
-			for _, host := range conf.Host {
-				confMap[host] = conf
+		var hosts []string
+		for _, host := range network.Hosts {
+			if !matchHost(expr, host) {
+				hosts = append(hosts, host)
+			} else {
+				skipHost(host, fmt.Sprintf("matches --except '%v' regexp", exceptHosts))
 			}
 		}
+		if len(hosts) == 0 {
+			fmt.Fprintln(os.Stderr, fmt.Errorf("no hosts left after --except '%v' regexp", exceptHosts))
+			os.Exit(1)
+		}
+		network.Hosts = hosts
+	}
 
-		// check network.Hosts for match
-		for _, host := range network.Hosts {
-			conf, found := confMap[host]
-			if found {
-				network.User = conf.User
-				network.IdentityFile = resolvePath(conf.IdentityFile)
-				network.Hosts = []string{fmt.Sprintf("%s:%d", conf.HostName, conf.Port)}
+	// --reverse flag reverses order of the hosts
+	if reverse {
+		for i, j := 0, len(network.Hosts)-1; i < j; i, j = i+1, j-1 {
+			network.Hosts[i], network.Hosts[j] = network.Hosts[j], network.Hosts[i]
+		}
+	}
+
+	network.IdentityFile = resolvePath(network.IdentityFile)
+	network.BastionIdentityFile = resolvePath(network.BastionIdentityFile)
+
+	// --ciphers, --kex and --macs flags override network's SSH algorithms
+	if sshCiphers != "" {
+		network.Ciphers = strings.Split(sshCiphers, ",")
+	}
+	if sshKeyExchanges != "" {
+		network.KeyExchanges = strings.Split(sshKeyExchanges, ",")
+	}
+	if sshMACs != "" {
+		network.MACs = strings.Split(sshMACs, ",")
+	}
+
+	// --insecure-ignore-host-key flag turns off host key verification
+	if insecureIgnoreHostKey {
+		network.InsecureIgnoreHostKey = true
+	}
+
+	// --port flag overrides network's default SSH port
+	if port != 0 {
+		network.Port = port
+	}
+
+	// --ask-pass flag prompts for the SSH password
+	if askPass {
+		network.AskPass = true
+	}
+
+	// --verbose flag prints the final list of hosts
+	if verbose {
+		fmt.Fprintf(os.Stderr, "Running on %v host(s): %v\n", len(network.Hosts), strings.Join(network.Hosts, ", "))
+	}
+
+	// Rewrite hosts found in ssh_config to their HostName, User and Port.
+	if sshHosts != nil {
+		for i, host := range network.Hosts {
+			resolved, hostConf, found := resolveSSHHost(sshHosts, host)
+			if !found {
+				continue
+			}
+			if hostConf.IdentityFile != "" {
+				network.IdentityFile = resolvePath(hostConf.IdentityFile)
+			}
+			network.Hosts[i] = resolved
+			if bastion, ok := network.HostBastion[host]; ok {
+				network.HostBastion[network.Hosts[i]] = bastion
+			}
+			if hostEnv, ok := network.HostEnv[host]; ok {
+				network.HostEnv[network.Hosts[i]] = hostEnv
+			}
+			for _, groupHosts := range network.HostGroups {
+				for j := range groupHosts {
+					if groupHosts[j] == host {
+						groupHosts[j] = network.Hosts[i]
+					}
+				}
+			}
+			if hostConf.ProxyCommand != "" && hostConf.ProxyCommand != "none" {
+				if network.HostProxyCommand == nil {
+					network.HostProxyCommand = map[string]string{}
+				}
+				network.HostProxyCommand[network.Hosts[i]] = hostConf.ProxyCommand
 			}
 		}
 	}
 
+	// Network's env files override global env, network's env overrides
+	// the env files.
+	envFileVars, err := network.ParseEnvFiles()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
 	var vars sup.EnvList
-	for _, val := range append(conf.Env, network.Env...) {
+	for _, val := range append(append(conf.Env, envFileVars...), network.Env...) {
 		vars.Set(val.Key, val.Value)
 	}
 	if err := vars.ResolveValues(); err != nil {
@@ -363,7 +951,10 @@ func main() {
 	for _, v := range cliVars {
 		supEnv += fmt.Sprintf(" -e %v=%q", v.Key, v.Value)
 	}
-	vars.Set("SUP_ENV", strings.TrimSpace(supEnv))
+	vars.SetLiteral("SUP_ENV", strings.TrimSpace(supEnv))
+
+	// SUP_HOSTS lists all hosts the commands are run on, after filtering.
+	vars.SetLiteral("SUP_HOSTS", strings.Join(network.Hosts, " "))
 
 	// Create new Stackup app.
 	app, err := sup.New(conf)
@@ -373,11 +964,314 @@ func main() {
 	}
 	app.Debug(debug)
 	app.Prefix(!disablePrefix)
+	app.Raw(raw)
+	app.MergeStderr(mergeStderr)
+	app.NoTTY(noTTY)
+	app.NoEnv(noEnv)
+	app.Forks(forks)
+	app.ConnectForks(connectForks)
+	app.Deadline(deadline)
+
+	// Prompt for the SSH password once, before connecting to any host.
+	if network.AskPass {
+		password, err := readPassword()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		app.Password(password)
+	}
+
+	// SUP_COLORS env var overrides the host prefix palette.
+	palette, err := sup.ParsePalette(os.Getenv("SUP_COLORS"))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, errors.Wrap(err, "SUP_COLORS"))
+		os.Exit(1)
+	}
+	if !sup.EnableColors() {
+		palette = sup.Monochrome
+	}
+	app.Colors(palette)
+
+	// SUP_TAR and SUP_REMOTE_TAR env vars override the tar command of uploads,
+	// ie. gtar on BSD hosts.
+	app.Tar(os.Getenv("SUP_TAR"), os.Getenv("SUP_REMOTE_TAR"))
+
+	// Collect results of all the commands.
+	var results []sup.Result
+	app.OnResult(func(res sup.Result) {
+		results = append(results, res)
+	})
+
+	// --audit-log flag records the final command string run on each host.
+	if auditLog != "" {
+		f, err := os.OpenFile(resolvePath(auditLog), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, errors.Wrap(err, "opening audit log failed"))
+			os.Exit(1)
+		}
+		defer f.Close()
+		redactor := sup.NewRedactor(vars)
+		app.OnResult(func(res sup.Result) {
+			if err := sup.WriteAudit(f, vars.Get("SUP_NETWORK"), res, redactor); err != nil {
+				fmt.Fprintln(os.Stderr, errors.Wrap(err, "writing audit log failed"))
+			}
+		})
+	}
+
+	// --archive-log flag collects output of the hosts, written to the archive
+	// at the end of the run.
+	var archive *sup.Archive
+	if archiveLog != "" {
+		archive = sup.NewArchive()
+		app.OnOutput(archive.Output)
+	}
+
+	// --facts flag prints facts about the hosts, instead of running commands.
+	if gatherFacts {
+		facts := conf.Facts
+		if len(facts) == 0 {
+			facts = sup.DefaultFacts
+		}
+		hostFacts, err := app.Facts(network, vars, facts)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if err := printFacts(os.Stdout, output, facts, hostFacts); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		for _, hf := range hostFacts {
+			if hf.Err != nil {
+				os.Exit(1)
+			}
+		}
+		return
+	}
+
+	// --ping flag only connects to the hosts, instead of running commands.
+	if ping {
+		pings, err := app.Ping(network, vars)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if err := printPings(os.Stdout, output, pings); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		for _, p := range pings {
+			if p.Err != nil {
+				os.Exit(1)
+			}
+		}
+		return
+	}
+
+	// --print-status flag prints exit code of each host, once the command's
+	// output is done.
+	if printStatus {
+		app.OnResult(func(res sup.Result) {
+			fmt.Printf("SUP-STATUS host=%v command=%v exit=%v\n", statusValue(res.Host), statusValue(res.Command), res.ExitCode)
+		})
+	}
 
 	// Run all the commands in the given network.
-	err = app.Run(network, vars, commands...)
+	start := time.Now()
+	if interactiveShell {
+		err = app.Shell(network, vars, os.Stdin, os.Stderr)
+	} else {
+		err = app.Run(network, vars, commands...)
+	}
+
+	// --metrics-file flag writes Prometheus metrics of the run
+	if metricsFile != "" {
+		if err := writeMetricsFile(metricsFile, vars.Get("SUP_NETWORK"), results); err != nil {
+			fmt.Fprintln(os.Stderr, errors.Wrap(err, "writing metrics failed"))
+		}
+	}
+
+	var names []string
+	for _, cmd := range commands {
+		names = append(names, cmd.Name)
+	}
+	summary := sup.NewSummary(vars.Get("SUP_NETWORK"), names, start, results, err)
+
+	// --notify-url flag posts a summary of the run; failing to notify
+	// doesn't change the exit code.
+	if notifyURL != "" {
+		if err := sup.Notify(notifyURL, notifyFormat, notifyTemplate, summary); err != nil {
+			fmt.Fprintln(os.Stderr, errors.Wrap(err, "notifying failed"))
+		}
+	}
+
+	// --archive-log flag writes the archive of the run; failing to write it
+	// doesn't change the exit code either.
+	if archive != nil {
+		if err := writeArchive(archiveLog, archive, data, vars, summary, results); err != nil {
+			fmt.Fprintln(os.Stderr, errors.Wrap(err, "writing archive log failed"))
+		}
+	}
+
 	if err != nil {
+		if e, ok := errors.Cause(err).(sup.ErrExitStatus); ok {
+			os.Exit(e.Status)
+		}
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 }
+
+// skipHost reports the host excluded by a filter, if --verbose.
+func skipHost(host, reason string) {
+	if verbose {
+		fmt.Fprintf(os.Stderr, "Skipping %v: %v\n", host, reason)
+	}
+}
+
+// readPassword returns the SSH password from the SUP_SSH_PASSWORD env var,
+// or prompts for it on the terminal with echo disabled.
+func readPassword() (string, error) {
+	if password := os.Getenv("SUP_SSH_PASSWORD"); password != "" {
+		return password, nil
+	}
+	if !terminal.IsTerminal(int(os.Stdin.Fd())) {
+		return "", ErrAskPassNoTTY
+	}
+	fmt.Fprint(os.Stderr, "SSH password: ")
+	password, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", errors.Wrap(err, "reading password failed")
+	}
+	return string(password), nil
+}
+
+// splitHost splits the host of the "[ssh://][user@]host[:port]" form.
+func splitHost(host string) (user, name, port string) {
+	name = strings.TrimPrefix(host, "ssh://")
+	if at := strings.LastIndex(name, "@"); at != -1 {
+		user, name = name[:at], name[at+1:]
+	}
+	if colon := strings.LastIndex(name, ":"); colon != -1 && !strings.Contains(name[colon+1:], "]") {
+		name, port = name[:colon], name[colon+1:]
+	}
+	return user, name, port
+}
+
+// resolveSSHHost returns the host with its HostName, User and Port of
+// the ssh_config, if it's found there.
+func resolveSSHHost(config *sup.SSHConfig, host string) (string, sup.SSHHostConfig, bool) {
+	if config == nil {
+		return host, sup.SSHHostConfig{}, false
+	}
+	user, name, port := splitHost(host)
+	hostConf, found := config.Lookup(name)
+	if !found {
+		return host, hostConf, false
+	}
+	if hostConf.HostName != "" {
+		name = hostConf.HostName
+	}
+	if user == "" {
+		user = hostConf.User
+	}
+	if port == "" && hostConf.Port != 0 {
+		port = strconv.Itoa(hostConf.Port)
+	}
+	return joinHost(user, name, port), hostConf, true
+}
+
+// joinHost returns the host of the "[user@]host[:port]" form.
+func joinHost(user, name, port string) string {
+	host := name
+	if user != "" {
+		host = user + "@" + host
+	}
+	if port != "" {
+		host += ":" + port
+	}
+	return host
+}
+
+// loadSupfiles reads the Supfiles and merges them in order, the later ones
+// override the earlier ones. It returns the merged Supfile, and the content
+// of all the files, each preceded by a comment of its path. No Supfiles
+// make an empty Supfile, ie. for the --hosts flag.
+func loadSupfiles(paths []string) (*sup.Supfile, []byte, error) {
+	if len(paths) == 0 {
+		conf, err := sup.NewSupfile(nil)
+		return conf, nil, err
+	}
+
+	var conf *sup.Supfile
+	var all []byte
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(resolvePath(path))
+		if err != nil {
+			return nil, nil, err
+		}
+		c, err := sup.NewSupfile(data)
+		if err != nil {
+			if len(paths) > 1 {
+				err = errors.Wrap(err, path)
+			}
+			return nil, nil, err
+		}
+		dir, err := filepath.Abs(filepath.Dir(resolvePath(path)))
+		if err != nil {
+			return nil, nil, err
+		}
+		c.ResolvePaths(dir)
+		if conf == nil {
+			conf = c
+		} else {
+			conf.Merge(c)
+		}
+		if len(paths) > 1 {
+			all = append(all, "# "+path+"\n"...)
+			if len(data) > 0 && data[len(data)-1] != '\n' {
+				data = append(data, '\n')
+			}
+		}
+		all = append(all, data...)
+	}
+	return conf, all, nil
+}
+
+// writeArchive writes the archive of the run to the file.
+func writeArchive(path string, archive *sup.Archive, supfile []byte, env sup.EnvList, summary sup.Summary, results []sup.Result) error {
+	f, err := os.OpenFile(resolvePath(path), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err := archive.Write(f, supfile, env, summary, results); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// writeMetricsFile writes the metrics to a temporary file first and renames it,
+// so the textfile collector never reads a partially written file.
+func writeMetricsFile(path, network string, results []sup.Result) error {
+	path = resolvePath(path)
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := sup.WriteMetrics(f, network, results); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -1,5 +1,11 @@
 package sup
 
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
 var (
 	Colors = []string{
 		"\033[32m", // green
@@ -10,4 +16,41 @@ var (
 		"\033[34m", // blue
 	}
 	ResetColor = "\033[0m"
+
+	// Monochrome is an empty palette; host prefixes are printed without colors.
+	Monochrome = []string{}
 )
+
+// ParsePalette parses a comma-separated list of ANSI SGR codes,
+// ie. "32,33,1;36", into a palette. The "none" and "mono" values
+// return the Monochrome palette, an empty value the default Colors.
+func ParsePalette(value string) ([]string, error) {
+	value = strings.TrimSpace(value)
+	switch value {
+	case "":
+		return Colors, nil
+	case "none", "mono", "monochrome":
+		return Monochrome, nil
+	}
+
+	var palette []string
+	for _, code := range strings.Split(value, ",") {
+		code = strings.TrimSpace(code)
+		for _, param := range strings.Split(code, ";") {
+			if _, err := strconv.Atoi(param); err != nil {
+				return nil, fmt.Errorf("invalid color code %q", code)
+			}
+		}
+		palette = append(palette, "\033["+code+"m")
+	}
+	return palette, nil
+}
+
+// colorize wraps s in the given color, leaving it untouched
+// if there's no color (ie. Monochrome palette).
+func colorize(color, s string) string {
+	if color == "" {
+		return s
+	}
+	return color + s + ResetColor
+}
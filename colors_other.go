@@ -0,0 +1,10 @@
+//go:build !windows
+// +build !windows
+
+package sup
+
+// EnableColors reports whether the terminal can render the ANSI color
+// codes. They're supported everywhere, but on old Windows consoles.
+func EnableColors() bool {
+	return true
+}
@@ -0,0 +1,24 @@
+package sup
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// EnableColors enables processing of the ANSI color codes by the Windows
+// console of STDOUT and STDERR. It reports false, if the console doesn't
+// support it, ie. before Windows 10, so colors should be disabled.
+func EnableColors() bool {
+	for _, f := range []*os.File{os.Stdout, os.Stderr} {
+		handle := windows.Handle(f.Fd())
+		var mode uint32
+		if err := windows.GetConsoleMode(handle, &mode); err != nil {
+			continue // Not a console, ie. redirected to a file.
+		}
+		if err := windows.SetConsoleMode(handle, mode|windows.ENABLE_VIRTUAL_TERMINAL_PROCESSING); err != nil {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,142 @@
+package sup
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// ControlClient runs the commands through the system ssh, multiplexed over
+// an already open OpenSSH ControlMaster socket, instead of dialing the host
+// natively. It reuses the authentication of the master connection, ie. MFA.
+type ControlClient struct {
+	local       *LocalhostClient // Runs the ssh command.
+	controlPath string           // ControlPath of the master, ie. "~/.ssh/cm-%r@%h:%p".
+	user        string
+	host        string
+	port        string
+	name        string // Host as given to Connect.
+	env         string //export FOO="bar"; export BAR="baz";
+	command     string // Command last started by Run.
+	color       string
+	defaultPort int    // Port of hosts without one. 22, if not set.
+	alias       string // Host name shown in the prefix instead of the dialed one, ie. by dial_host.
+}
+
+// Connect checks the ControlMaster of the host is running. It doesn't
+// open a new connection, if it isn't.
+func (c *ControlClient) Connect(host string) error {
+	parsed := &SSHClient{user: c.user, port: c.defaultPort}
+	if err := parsed.parseHost(host); err != nil {
+		return err
+	}
+	hostname, port, err := net.SplitHostPort(parsed.host)
+	if err != nil {
+		return ErrConnect{parsed.user, parsed.host, err.Error()}
+	}
+	c.name, c.user, c.host, c.port = host, parsed.user, hostname, port
+
+	out, err := exec.Command("ssh", c.args("-O", "check")...).CombinedOutput()
+	if err != nil {
+		return ErrConnect{c.user, c.host + ":" + c.port, fmt.Sprintf("no ControlMaster running at %v: %v", c.controlPath, strings.TrimSpace(string(out)))}
+	}
+
+	c.local = &LocalhostClient{}
+	return c.local.Connect(host)
+}
+
+// args returns the arguments of ssh to run the command through the
+// ControlMaster. ControlMaster=no never opens a connection of its own.
+func (c *ControlClient) args(args ...string) []string {
+	return append([]string{
+		"-S", c.controlPath,
+		"-o", "ControlMaster=no",
+		"-o", "BatchMode=yes",
+		"-o", "LogLevel=ERROR",
+		"-p", c.port,
+		"-l", c.user,
+	}, append(args, c.host)...)
+}
+
+// Run runs the task.Run command on the host through the ControlMaster.
+func (c *ControlClient) Run(task *Task) error {
+	tty := "-T"
+	if task.TTY {
+		tty = "-tt"
+	}
+	c.command = remoteCommand(c.env, task)
+
+	var ssh []string
+	for _, arg := range append(c.args(tty), c.command) {
+		ssh = append(ssh, shellQuote(arg))
+	}
+	return c.local.Run(&Task{Run: "exec ssh " + strings.Join(ssh, " ")})
+}
+
+func (c *ControlClient) Wait() error {
+	return c.local.Wait()
+}
+
+// Close kills the running ssh command, if any. The ControlMaster keeps
+// running.
+func (c *ControlClient) Close() error {
+	if c.local == nil {
+		return nil
+	}
+	return c.local.Close()
+}
+
+// Host returns the host as given to Connect.
+func (c *ControlClient) Host() string {
+	return c.name
+}
+
+// Command returns the final command string last started by Run on the
+// remote host, including the exported environment variables.
+func (c *ControlClient) Command() string {
+	return c.command
+}
+
+// appendEnv exports the env vars of the export statements to the
+// subsequent commands, see Stackup.register.
+func (c *ControlClient) appendEnv(exports string) {
+	c.env += exports
+}
+
+func (c *ControlClient) Stdin() io.WriteCloser {
+	return c.local.Stdin()
+}
+
+func (c *ControlClient) Stderr() io.Reader {
+	return c.local.Stderr()
+}
+
+func (c *ControlClient) Stdout() io.Reader {
+	return c.local.Stdout()
+}
+
+func (c *ControlClient) Prefix() (string, int) {
+	host := c.user + "@" + withAlias(net.JoinHostPort(c.host, c.port), c.alias) + " | "
+	return colorize(c.color, host), len(host)
+}
+
+func (c *ControlClient) Write(p []byte) (n int, err error) {
+	return c.local.Write(p)
+}
+
+func (c *ControlClient) WriteClose() error {
+	return c.local.WriteClose()
+}
+
+// Signal interrupts the remote command like SSHClient does, and stops
+// the ssh command. Without a pseudo terminal, the remote command may
+// keep running.
+func (c *ControlClient) Signal(sig os.Signal) error {
+	if sig == os.Interrupt {
+		c.local.Write([]byte("\x03"))
+	}
+	return c.local.Signal(sig)
+}
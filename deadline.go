@@ -0,0 +1,130 @@
+package sup
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ErrDeadline is returned by Run, if the run exceeds its deadline.
+type ErrDeadline struct {
+	Deadline time.Duration
+	Hosts    []string // Hosts the commands were still running on.
+}
+
+func (e ErrDeadline) Error() string {
+	if len(e.Hosts) == 0 {
+		return fmt.Sprintf("run exceeded deadline of %v", e.Deadline)
+	}
+	return fmt.Sprintf("run exceeded deadline of %v, still in progress on %v", e.Deadline, strings.Join(e.Hosts, ", "))
+}
+
+// DeadlineGrace is how long the commands still running, once the deadline
+// is exceeded, get to exit on interrupt and flush their output, before
+// their connections are closed.
+var DeadlineGrace = 2 * time.Second
+
+// partialOutputSize limits the output of a timed out command kept
+// for its Result.
+const partialOutputSize = 4096
+
+// startRunning marks the client as running a task, so it's closed once
+// the deadline is exceeded. It fails, if the deadline is exceeded already.
+func (sup *Stackup) startRunning(c Client) error {
+	sup.runningMu.Lock()
+	defer sup.runningMu.Unlock()
+
+	if sup.exceeded != nil {
+		return *sup.exceeded
+	}
+	if sup.running == nil {
+		sup.running = map[Client]bool{}
+	}
+	sup.running[c] = true
+	return nil
+}
+
+// stopRunning marks the client as done with its task.
+func (sup *Stackup) stopRunning(c Client) {
+	sup.runningMu.Lock()
+	defer sup.runningMu.Unlock()
+
+	delete(sup.running, c)
+}
+
+// deadlineExceeded returns ErrDeadline, if the deadline is exceeded.
+func (sup *Stackup) deadlineExceeded() error {
+	sup.runningMu.Lock()
+	defer sup.runningMu.Unlock()
+
+	if sup.exceeded != nil {
+		return *sup.exceeded
+	}
+	return nil
+}
+
+// exceed interrupts all the clients running a task, so the run is aborted.
+// The clients still running after DeadlineGrace are closed.
+func (sup *Stackup) exceed() {
+	sup.runningMu.Lock()
+	defer sup.runningMu.Unlock()
+
+	e := ErrDeadline{Deadline: sup.deadline}
+	sup.timedOut = map[Client]bool{}
+	for c := range sup.running {
+		e.Hosts = append(e.Hosts, clientHost(c))
+		sup.timedOut[c] = true
+	}
+	sort.Strings(e.Hosts)
+	sup.exceeded = &e
+
+	timedOut := sup.timedOut
+	for c := range sup.running {
+		c.Signal(os.Interrupt)
+	}
+	time.AfterFunc(DeadlineGrace, func() {
+		sup.runningMu.Lock()
+		defer sup.runningMu.Unlock()
+
+		for c := range sup.running {
+			if timedOut[c] {
+				c.Close()
+			}
+		}
+	})
+}
+
+// resetRun clears the deadline and the cancelled hosts of the previous run.
+func (sup *Stackup) resetRun() {
+	sup.runningMu.Lock()
+	defer sup.runningMu.Unlock()
+
+	sup.exceeded = nil
+	sup.timedOut = nil
+	sup.cancelled = nil
+}
+
+// isTimedOut reports whether the client was running a task, when
+// the deadline was exceeded.
+func (sup *Stackup) isTimedOut(c Client) bool {
+	sup.runningMu.Lock()
+	defer sup.runningMu.Unlock()
+
+	return sup.timedOut[c]
+}
+
+// tailBuffer keeps the last size bytes written to it.
+type tailBuffer struct {
+	size int
+	buf  []byte
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+	if len(t.buf) > t.size {
+		t.buf = append(t.buf[:0], t.buf[len(t.buf)-t.size:]...)
+	}
+	return len(p), nil
+}
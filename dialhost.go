@@ -0,0 +1,68 @@
+package sup
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// dialHost transforms the host name of the network's host by dial_host or
+// dial_host_command, ie. to append a DNS suffix to an inventory of short
+// names. It returns the host to connect to, with the user and port kept as
+// they were, and the original host name to show in the prefix. The host is
+// returned as is, if there's no transform.
+func (n Network) dialHost(host string) (string, string, error) {
+	if n.DialHost == "" && n.DialHostCommand == "" {
+		return host, "", nil
+	}
+
+	addr := strings.TrimPrefix(host, "ssh://")
+	user, login := n.User, ""
+	if at := strings.LastIndex(addr, "@"); at != -1 {
+		user, login, addr = addr[:at], addr[:at+1], addr[at+1:]
+	}
+	hostname, port := addr, strconv.Itoa(n.Port)
+	if n.Port == 0 {
+		port = "22"
+	}
+	if h, p, err := net.SplitHostPort(addr); err == nil {
+		hostname, port = h, p
+	}
+
+	var dialed string
+	if n.DialHostCommand != "" {
+		command := expandProxyTokens(n.DialHostCommand, hostname, port, user)
+		var stderr bytes.Buffer
+		cmd := exec.Command("/bin/sh", "-c", command)
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return "", "", errors.Wrapf(err, "dial_host_command %q failed: %v", command, strings.TrimSpace(stderr.String()))
+		}
+		dialed = strings.TrimSpace(string(out))
+		if dialed == "" {
+			return "", "", fmt.Errorf("dial_host_command %q printed no host", command)
+		}
+	} else {
+		dialed = expandProxyTokens(n.DialHost, hostname, port, user)
+	}
+
+	return login + net.JoinHostPort(dialed, port), hostname, nil
+}
+
+// withAlias replaces the host name of the host:port by the alias, if set.
+func withAlias(hostport, alias string) string {
+	if alias == "" {
+		return hostport
+	}
+	_, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return alias
+	}
+	return net.JoinHostPort(alias, port)
+}
@@ -0,0 +1,141 @@
+package sup
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// defaultDrainTimeout is the time to poll a draining host for at most,
+// if the drain has no timeout.
+const defaultDrainTimeout = 5 * time.Minute
+
+// drain takes the task's clients out of service by the command's drain,
+// before the task runs on them. It runs the drain's run command quietly on
+// all of them, like the poll, so it isn't reported as the command's result,
+// then polls each of them until its active connections drop to the
+// threshold, or the timeout passes, and proceeds either way.
+func (sup *Stackup) drain(cmd *Command, task *Task) error {
+	d := cmd.Drain
+	if d.Run != "" {
+		var wg sync.WaitGroup
+		errs := make([]error, len(task.Clients))
+		for i, c := range task.Clients {
+			wg.Add(1)
+			go func(i int, c Client) {
+				defer wg.Done()
+				run := &Task{
+					Run:     d.Run,
+					Clients: []Client{c},
+					Shell:   task.Shell,
+					Login:   task.Login,
+				}
+				if _, err := runCapture(c, run); err != nil {
+					errs[i] = errors.Wrapf(err, "%v: drain failed on %v", cmd.Name, clientHost(c))
+				}
+			}(i, c)
+		}
+		wg.Wait()
+		for _, err := range errs {
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if d.Poll == "" {
+		return nil
+	}
+
+	interval := time.Duration(d.Interval) * time.Second
+	if interval == 0 {
+		interval = time.Second
+	}
+	timeout := time.Duration(d.Timeout) * time.Second
+	if timeout == 0 {
+		timeout = defaultDrainTimeout
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(task.Clients))
+	for i, c := range task.Clients {
+		wg.Add(1)
+		go func(i int, c Client) {
+			defer wg.Done()
+			poll := &Task{
+				Run:     d.Poll,
+				Clients: []Client{c},
+				Shell:   task.Shell,
+				Login:   task.Login,
+			}
+			deadline := time.Now().Add(timeout)
+			for {
+				out, err := runCapture(c, poll)
+				if err != nil {
+					errs[i] = errors.Wrapf(err, "%v: drain poll failed on %v", cmd.Name, clientHost(c))
+					return
+				}
+				active, err := strconv.Atoi(strings.TrimSpace(out))
+				if err != nil {
+					errs[i] = fmt.Errorf("%v: drain poll on %v printed %q, expected number of active connections", cmd.Name, clientHost(c), strings.TrimSpace(out))
+					return
+				}
+				if active <= d.Threshold {
+					sup.log(LogEntry{
+						Level:   LogInfo,
+						Message: fmt.Sprintf("%v: %v drained, %v active connection(s)", cmd.Name, clientHost(c), active),
+						Host:    clientHost(c),
+						Command: cmd.Name,
+					})
+					return
+				}
+				if time.Now().Add(interval).After(deadline) {
+					sup.log(LogEntry{
+						Level:   LogWarn,
+						Message: fmt.Sprintf("%v: %v still has %v active connection(s) after %v, proceeding", cmd.Name, clientHost(c), active, timeout),
+						Host:    clientHost(c),
+						Command: cmd.Name,
+					})
+					return
+				}
+				time.Sleep(interval)
+			}
+		}(i, c)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runCapture runs the task on the client quietly, and returns its STDOUT.
+// The STDERR is discarded.
+func runCapture(c Client, task *Task) (string, error) {
+	if err := c.Run(task); err != nil {
+		return "", err
+	}
+	var stdout bytes.Buffer
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(&stdout, c.Stdout())
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(ioutil.Discard, c.Stderr())
+	}()
+	err := c.Wait()
+	wg.Wait()
+	return stdout.String(), err
+}
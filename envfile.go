@@ -0,0 +1,68 @@
+package sup
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ParseEnvFiles parses the network's env files in order, so the later files
+// override the earlier ones. Missing files prefixed by "-" are skipped.
+func (n Network) ParseEnvFiles() (EnvList, error) {
+	var env EnvList
+	for _, path := range n.EnvFile {
+		optional := strings.HasPrefix(path, "-")
+		path = strings.TrimPrefix(path, "-")
+
+		f, err := os.Open(path)
+		if os.IsNotExist(err) && optional {
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "opening env file failed")
+		}
+
+		vars, err := ParseEnvFile(f)
+		f.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, path)
+		}
+		for _, v := range vars {
+			env.Set(v.Key, v.Value)
+		}
+	}
+	return env, nil
+}
+
+// ParseEnvFile parses KEY=VALUE lines of a .env file. Empty lines, comments
+// and "export" keywords are skipped. Values are kept as they are, including
+// quotes, and resolved by shell later on the same as Supfile env vars.
+func ParseEnvFile(r io.Reader) (EnvList, error) {
+	var env EnvList
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("line %v: expected KEY=VALUE, got %q", lineNo, line)
+		}
+		key := strings.TrimSpace(kv[0])
+		if key == "" || strings.ContainsAny(key, " \t") {
+			return nil, fmt.Errorf("line %v: invalid variable name %q", lineNo, key)
+		}
+		env.Set(key, strings.TrimSpace(kv[1]))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return env, nil
+}
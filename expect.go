@@ -0,0 +1,62 @@
+package sup
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+
+	"github.com/pkg/errors"
+)
+
+// expectation is the STDOUT a command's task must print on each host,
+// see Command.Expect, Command.ExpectNot and Command.ExpectEmpty.
+type expectation struct {
+	match   *regexp.Regexp
+	noMatch *regexp.Regexp
+	empty   bool
+}
+
+// newExpectation compiles the command's expectations of its STDOUT.
+// It returns nil, if the command has none.
+func newExpectation(cmd *Command) (*expectation, error) {
+	if cmd.Expect == "" && cmd.ExpectNot == "" && !cmd.ExpectEmpty {
+		return nil, nil
+	}
+	e := &expectation{empty: cmd.ExpectEmpty}
+	var err error
+	if cmd.Expect != "" {
+		if e.match, err = regexp.Compile(cmd.Expect); err != nil {
+			return nil, errors.Wrap(err, "expect")
+		}
+	}
+	if cmd.ExpectNot != "" {
+		if e.noMatch, err = regexp.Compile(cmd.ExpectNot); err != nil {
+			return nil, errors.Wrap(err, "expect_not")
+		}
+	}
+	return e, nil
+}
+
+// check returns ErrExpect, if the STDOUT doesn't meet the expectation.
+func (e *expectation) check(stdout []byte) error {
+	if e.empty && len(bytes.TrimSpace(stdout)) > 0 {
+		return ErrExpect{"output is not empty"}
+	}
+	if e.match != nil && !e.match.Match(stdout) {
+		return ErrExpect{fmt.Sprintf("output doesn't match %q", e.match)}
+	}
+	if e.noMatch != nil && e.noMatch.Match(stdout) {
+		return ErrExpect{fmt.Sprintf("output matches %q", e.noMatch)}
+	}
+	return nil
+}
+
+// ErrExpect fails the host, whose command exited successfully, but its
+// output didn't meet the command's expectation.
+type ErrExpect struct {
+	Reason string
+}
+
+func (e ErrExpect) Error() string {
+	return "expectation failed: " + e.Reason
+}
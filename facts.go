@@ -0,0 +1,117 @@
+package sup
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Fact is a shell command printing a single fact about a host.
+// Only the first line of its output is kept.
+type Fact struct {
+	Name string `yaml:"name"`
+	Run  string `yaml:"run"`
+}
+
+// DefaultFacts are gathered by Facts, unless the Supfile defines its own.
+var DefaultFacts = []Fact{
+	{Name: "os", Run: `[ -f /etc/os-release ] && . /etc/os-release && echo "$PRETTY_NAME" || uname -s`},
+	{Name: "kernel", Run: `uname -r`},
+	{Name: "arch", Run: `uname -m`},
+	{Name: "hostname", Run: `hostname`},
+	{Name: "uptime", Run: `uptime -p || uptime`},
+	{Name: "cpus", Run: `nproc || getconf _NPROCESSORS_ONLN`},
+	{Name: "mem", Run: `awk '/^MemTotal:/ { printf "%d MiB\n", $2 / 1024 }' /proc/meminfo || sysctl -n hw.memsize`},
+}
+
+// HostFacts are the facts gathered from a single host.
+type HostFacts struct {
+	Host  string
+	Facts map[string]string
+	Err   error // Gathering the facts failed.
+}
+
+// factsScript returns a script printing each fact on its own line,
+// prefixed by its name and a tab.
+func factsScript(facts []Fact) string {
+	var script strings.Builder
+	for _, fact := range facts {
+		script.WriteString("printf '%s\\t' " + shellQuote(fact.Name) + "; { " + fact.Run + "\n} 2>/dev/null | head -n 1 | tr -d '\\n'; echo;\n")
+	}
+	return script.String()
+}
+
+// parseFacts parses the output of factsScript.
+func parseFacts(r io.Reader) map[string]string {
+	facts := map[string]string{}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		i := strings.Index(scanner.Text(), "\t")
+		if i < 0 {
+			continue
+		}
+		facts[scanner.Text()[:i]] = strings.TrimSpace(scanner.Text()[i+1:])
+	}
+	return facts
+}
+
+// Facts connects to all the hosts of the network and gathers the facts
+// about them, ie. DefaultFacts, instead of running any commands. The facts
+// are returned in the order of the hosts.
+func (sup *Stackup) Facts(network *Network, envVars EnvList, facts []Fact) ([]HostFacts, error) {
+	defer sup.closeBastions()
+	clients, err := sup.connect(network, envVars.AsExport(), "")
+	if err != nil {
+		return nil, err
+	}
+	defer closeClients(clients)
+
+	script := factsScript(facts)
+	hostFacts := make([]HostFacts, len(clients))
+
+	var wg sync.WaitGroup
+	for i, c := range clients {
+		wg.Add(1)
+		go func(i int, c Client) {
+			defer wg.Done()
+			hostFacts[i].Host = clientHost(c)
+
+			task := &Task{
+				Run:     script,
+				Clients: []Client{c},
+			}
+			if err := c.Run(task); err != nil {
+				hostFacts[i].Err = errors.Wrap(err, "gathering facts failed")
+				return
+			}
+			c.WriteClose()
+
+			var stdout bytes.Buffer
+			var ioWg sync.WaitGroup
+			ioWg.Add(2)
+			go func() {
+				defer ioWg.Done()
+				io.Copy(&stdout, c.Stdout())
+			}()
+			go func() {
+				defer ioWg.Done()
+				io.Copy(ioutil.Discard, c.Stderr())
+			}()
+			err := c.Wait()
+			ioWg.Wait()
+			if err != nil {
+				hostFacts[i].Err = errors.Wrap(err, "gathering facts failed")
+				return
+			}
+			hostFacts[i].Facts = parseFacts(&stdout)
+		}(i, c)
+	}
+	wg.Wait()
+
+	return hostFacts, nil
+}
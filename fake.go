@@ -0,0 +1,234 @@
+package sup
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// ClientFactory creates a client connected to the host, with the env
+// exported before each of its commands. It replaces the SSH and localhost
+// clients of Stackup, ie. by FakeClients in tests.
+type ClientFactory func(host, env string) (Client, error)
+
+// FakeReply is the scripted outcome of a command run on a FakeClient.
+type FakeReply struct {
+	Stdout   string
+	Stderr   string
+	ExitCode int
+}
+
+// FakeExitError is returned by FakeClient's Wait for non-zero exit codes.
+type FakeExitError struct {
+	Status int
+}
+
+func (e *FakeExitError) Error() string {
+	return fmt.Sprintf("Process exited with status %v", e.Status)
+}
+
+// ExitStatus returns the exit code of the command.
+func (e *FakeExitError) ExitStatus() int {
+	return e.Status
+}
+
+// FakeClient is an in-memory Client, which doesn't run anything. It records
+// the commands and their input, and replies with scripted output and exit
+// codes, so orchestration built on Stackup can be unit-tested.
+type FakeClient struct {
+	host  string
+	env   string
+	reply func(run string) FakeReply
+
+	mu       sync.Mutex
+	commands []string
+	input    bytes.Buffer
+
+	running bool
+	stdout  io.Reader
+	stderr  io.Reader
+	exit    int
+	last    string
+}
+
+// NewFakeClient returns a FakeClient replying to the commands by reply.
+// Commands succeed without any output, if reply is nil.
+func NewFakeClient(host, env string, reply func(run string) FakeReply) *FakeClient {
+	return &FakeClient{
+		host:  host,
+		env:   env,
+		reply: reply,
+	}
+}
+
+func (c *FakeClient) Connect(host string) error {
+	c.host = host
+	return nil
+}
+
+func (c *FakeClient) Run(task *Task) error {
+	if c.running {
+		return fmt.Errorf("Command already running")
+	}
+
+	var reply FakeReply
+	if c.reply != nil {
+		reply = c.reply(task.Run)
+	}
+	c.mu.Lock()
+	c.commands = append(c.commands, task.Run)
+	c.mu.Unlock()
+
+	c.last = c.env + task.Run
+	c.stdout = bytes.NewBufferString(reply.Stdout)
+	c.stderr = bytes.NewBufferString(reply.Stderr)
+	c.exit = reply.ExitCode
+	c.running = true
+	return nil
+}
+
+func (c *FakeClient) Command() string {
+	return c.last
+}
+
+// appendEnv exports the env vars of the export statements to the
+// subsequent commands, see Stackup.register.
+func (c *FakeClient) appendEnv(exports string) {
+	c.env += exports
+}
+
+func (c *FakeClient) Wait() error {
+	if !c.running {
+		return fmt.Errorf("Trying to wait on stopped command")
+	}
+	c.running = false
+	if c.exit != 0 {
+		return &FakeExitError{c.exit}
+	}
+	return nil
+}
+
+func (c *FakeClient) Close() error {
+	return nil
+}
+
+func (c *FakeClient) Host() string {
+	return c.host
+}
+
+func (c *FakeClient) Prefix() (string, int) {
+	host := c.host + " | "
+	return host, len(host)
+}
+
+func (c *FakeClient) Write(p []byte) (n int, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.input.Write(p)
+}
+
+func (c *FakeClient) WriteClose() error {
+	return nil
+}
+
+func (c *FakeClient) Stdin() io.WriteCloser {
+	return c
+}
+
+func (c *FakeClient) Stderr() io.Reader {
+	if c.stderr == nil {
+		return bytes.NewReader(nil)
+	}
+	return c.stderr
+}
+
+func (c *FakeClient) Stdout() io.Reader {
+	if c.stdout == nil {
+		return bytes.NewReader(nil)
+	}
+	return c.stdout
+}
+
+func (c *FakeClient) Signal(sig os.Signal) error {
+	return nil
+}
+
+// Commands returns the commands run on the client, in order.
+func (c *FakeClient) Commands() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]string{}, c.commands...)
+}
+
+// Input returns everything written to STDIN of the client's commands.
+func (c *FakeClient) Input() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]byte{}, c.input.Bytes()...)
+}
+
+// FakeClients creates FakeClients for Stackup's ClientFactory and keeps
+// them by host, so tests can check which commands ran on which hosts.
+type FakeClients struct {
+	// Reply scripts the outcome of the command on the host. Commands
+	// succeed without any output, if nil.
+	Reply func(host, run string) FakeReply
+
+	mu      sync.Mutex
+	clients map[string][]*FakeClient
+}
+
+// New creates a FakeClient of the host. It's a ClientFactory.
+func (f *FakeClients) New(host, env string) (Client, error) {
+	var reply func(string) FakeReply
+	if f.Reply != nil {
+		reply = func(run string) FakeReply {
+			return f.Reply(host, run)
+		}
+	}
+	c := NewFakeClient(host, env, reply)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.clients == nil {
+		f.clients = map[string][]*FakeClient{}
+	}
+	f.clients[host] = append(f.clients[host], c)
+	return c, nil
+}
+
+// Commands returns the commands run on the host by all its clients, in order.
+func (f *FakeClients) Commands(host string) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var commands []string
+	for _, c := range f.clients[host] {
+		commands = append(commands, c.Commands()...)
+	}
+	return commands
+}
+
+// Ran reports whether the command ran on the host.
+func (f *FakeClients) Ran(host, run string) bool {
+	for _, command := range f.Commands(host) {
+		if command == run {
+			return true
+		}
+	}
+	return false
+}
+
+// Hosts returns the sorted hosts the clients were created for.
+func (f *FakeClients) Hosts() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var hosts []string
+	for host := range f.clients {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
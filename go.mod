@@ -1,14 +1,17 @@
 module github.com/pressly/sup
 
-go 1.13
+go 1.18
 
 require (
 	github.com/goware/prefixer v0.0.0-20160118172347-395022866408
-	github.com/kr/pretty v0.2.0 // indirect
-	github.com/mikkeloscar/sshconfig v0.0.0-20190102082740-ec0822bcc4f4
+	github.com/klauspost/compress v1.16.7
 	github.com/pkg/errors v0.9.1
 	golang.org/x/crypto v0.0.0-20200208060501-ecb85df21340
-	golang.org/x/sys v0.0.0-20200202164722-d101bd2416d5 // indirect
-	gopkg.in/check.v1 v1.0.0-20190902080502-41f04d3bba15 // indirect
+	golang.org/x/sys v0.0.0-20200202164722-d101bd2416d5
 	gopkg.in/yaml.v2 v2.2.8
 )
+
+require (
+	github.com/kr/pretty v0.2.0 // indirect
+	gopkg.in/check.v1 v1.0.0-20190902080502-41f04d3bba15 // indirect
+)
@@ -0,0 +1,49 @@
+package sup
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// NewHostKeyCallback returns a callback verifying host keys against
+// the user's ~/.ssh/known_hosts file. If insecure, it returns a callback
+// accepting any host key instead and prints a warning.
+func NewHostKeyCallback(insecure bool) (ssh.HostKeyCallback, error) {
+	if insecure {
+		fmt.Fprintln(os.Stderr, "WARNING: Host keys are not verified, connections are open to man-in-the-middle attacks")
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, errors.Wrap(err, "locating known_hosts failed")
+	}
+
+	// Missing known_hosts file means no host is known yet.
+	var files []string
+	path := filepath.Join(home, ".ssh", "known_hosts")
+	if _, err := os.Stat(path); err == nil {
+		files = append(files, path)
+	}
+	callback, err := knownhosts.New(files...)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing known_hosts failed")
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := callback(hostname, remote, key)
+		if e, ok := err.(*knownhosts.KeyError); ok {
+			if len(e.Want) == 0 {
+				return fmt.Errorf("host key of %v is unknown, add it to %v (ie. by ssh-keyscan) or use --insecure-ignore-host-key", hostname, path)
+			}
+			return fmt.Errorf("host key of %v doesn't match %v:%v, possible man-in-the-middle attack", hostname, e.Want[0].Filename, e.Want[0].Line)
+		}
+		return err
+	}, nil
+}
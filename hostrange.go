@@ -0,0 +1,88 @@
+package sup
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ExpandHostRange expands ranges in square brackets of the host pattern,
+// ie. "web[01:10].example.com" to web01.example.com ... web10.example.com,
+// or "db-[a:c]" to db-a, db-b and db-c. Numeric ranges starting by zero
+// are zero-padded to the width of the start. Brackets that don't contain
+// a single ":", ie. IPv6 addresses like "[::1]:22", are kept as they are.
+func ExpandHostRange(pattern string) ([]string, error) {
+	hosts, err := expandHostRange(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("host %q: %v", pattern, err)
+	}
+	return hosts, nil
+}
+
+func expandHostRange(pattern string) ([]string, error) {
+	start := strings.Index(pattern, "[")
+	if start == -1 {
+		return []string{pattern}, nil
+	}
+	end := strings.Index(pattern[start:], "]")
+	if end == -1 {
+		return nil, fmt.Errorf("unclosed range %v", pattern[start:])
+	}
+	end += start
+
+	rest, err := expandHostRange(pattern[end+1:])
+	if err != nil {
+		return nil, err
+	}
+
+	// Not a range, ie. an IPv6 address.
+	values := []string{pattern[start : end+1]}
+	if inner := pattern[start+1 : end]; strings.Count(inner, ":") == 1 {
+		values, err = expandRange(inner)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var hosts []string
+	for _, v := range values {
+		for _, r := range rest {
+			hosts = append(hosts, pattern[:start]+v+r)
+		}
+	}
+	return hosts, nil
+}
+
+// expandRange expands the "from:to" range, either numeric or alphabetic.
+func expandRange(r string) ([]string, error) {
+	parts := strings.SplitN(r, ":", 2)
+	from, to := parts[0], parts[1]
+
+	if a, err := strconv.Atoi(from); err == nil {
+		b, err := strconv.Atoi(to)
+		if err != nil || a < 0 || a > b {
+			return nil, fmt.Errorf("invalid range [%v], expected ie. [01:10]", r)
+		}
+		format := "%d"
+		if len(from) > 1 && from[0] == '0' {
+			format = "%0" + strconv.Itoa(len(from)) + "d"
+		}
+		var values []string
+		for i := a; i <= b; i++ {
+			values = append(values, fmt.Sprintf(format, i))
+		}
+		return values, nil
+	}
+
+	isLetter := func(s string) bool {
+		return len(s) == 1 && (s[0] >= 'a' && s[0] <= 'z' || s[0] >= 'A' && s[0] <= 'Z')
+	}
+	if !isLetter(from) || !isLetter(to) || from > to || (from[0] <= 'Z') != (to[0] <= 'Z') {
+		return nil, fmt.Errorf("invalid range [%v], expected ie. [01:10] or [a:f]", r)
+	}
+	var values []string
+	for c := from[0]; c <= to[0]; c++ {
+		values = append(values, string(c))
+	}
+	return values, nil
+}
@@ -0,0 +1,214 @@
+package sup
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ParseInventoryFile parses the network's Ansible-style INI inventory file,
+// if provided, and returns hosts of the network's inventory group (or all
+// hosts, if no group is set).
+func (n Network) ParseInventoryFile() ([]string, error) {
+	if n.InventoryFile == "" {
+		return nil, nil
+	}
+
+	f, err := os.Open(n.InventoryFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening inventory file failed")
+	}
+	defer f.Close()
+
+	hosts, err := ParseINIInventory(f, n.InventoryGroup)
+	if err != nil {
+		return nil, errors.Wrap(err, n.InventoryFile)
+	}
+	return hosts, nil
+}
+
+// inventoryHost is a host entry of INI inventory.
+type inventoryHost struct {
+	name string
+	vars map[string]string
+}
+
+// ParseINIInventory parses an Ansible-style INI inventory and returns hosts
+// of the given group, or all hosts if the group is empty. The hosts are
+// returned in the "user@host:port" form, as defined by the ansible_user,
+// ansible_host and ansible_port variables. Supported sections are [group],
+// [group:vars] and [group:children].
+func ParseINIInventory(r io.Reader, group string) ([]string, error) {
+	var (
+		hostVars   = map[string]map[string]string{}
+		groupNames = []string{"ungrouped"}
+		groups     = map[string][]string{"ungrouped": {}}
+		groupVars  = map[string]map[string]string{}
+		children   = map[string][]string{}
+	)
+
+	section, kind := "ungrouped", ""
+	scanner := bufio.NewScanner(r)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		// Skip empty lines and comments.
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+
+		if line[0] == '[' {
+			if line[len(line)-1] != ']' {
+				return nil, fmt.Errorf("line %v: malformed section %q", lineNo, line)
+			}
+			section, kind = line[1:len(line)-1], ""
+			if i := strings.Index(section, ":"); i != -1 {
+				section, kind = section[:i], section[i+1:]
+			}
+			if kind != "" && kind != "vars" && kind != "children" {
+				return nil, fmt.Errorf("line %v: unsupported section %q", lineNo, line)
+			}
+			if _, ok := groups[section]; !ok {
+				groupNames = append(groupNames, section)
+				groups[section] = []string{}
+			}
+			continue
+		}
+
+		switch kind {
+		case "vars":
+			kv := strings.SplitN(line, "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("line %v: expected key=value, got %q", lineNo, line)
+			}
+			if groupVars[section] == nil {
+				groupVars[section] = map[string]string{}
+			}
+			groupVars[section][strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+
+		case "children":
+			children[section] = append(children[section], line)
+
+		default:
+			fields := strings.Fields(line)
+			name := fields[0]
+			if _, ok := hostVars[name]; !ok {
+				hostVars[name] = map[string]string{}
+			}
+			for _, field := range fields[1:] {
+				kv := strings.SplitN(field, "=", 2)
+				if len(kv) != 2 {
+					return nil, fmt.Errorf("line %v: expected key=value, got %q", lineNo, field)
+				}
+				hostVars[name][kv[0]] = kv[1]
+			}
+			groups[section] = append(groups[section], name)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// Resolve hosts and variables of the requested group, including child groups.
+	var (
+		names   []string
+		vars    = map[string]map[string]string{}
+		visited = map[string]bool{}
+		visit   func(group string, inherited map[string]string) error
+	)
+	visit = func(group string, inherited map[string]string) error {
+		if visited[group] {
+			return nil
+		}
+		visited[group] = true
+
+		if _, ok := groups[group]; !ok {
+			return fmt.Errorf("unknown group %q", group)
+		}
+		merged := map[string]string{}
+		for k, v := range inherited {
+			merged[k] = v
+		}
+		for k, v := range groupVars[group] {
+			merged[k] = v
+		}
+
+		for _, name := range groups[group] {
+			if _, ok := vars[name]; !ok {
+				names = append(names, name)
+				vars[name] = map[string]string{}
+			}
+			for k, v := range merged {
+				if _, ok := vars[name][k]; !ok {
+					vars[name][k] = v
+				}
+			}
+		}
+		for _, child := range children[group] {
+			if err := visit(child, merged); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if group == "" || group == "all" {
+		// Visit top-level groups only; child groups inherit parents' vars.
+		isChild := map[string]bool{}
+		for _, groups := range children {
+			for _, child := range groups {
+				isChild[child] = true
+			}
+		}
+		for _, group := range groupNames {
+			if isChild[group] {
+				continue
+			}
+			if err := visit(group, groupVars["all"]); err != nil {
+				return nil, err
+			}
+		}
+	} else if err := visit(group, groupVars["all"]); err != nil {
+		return nil, err
+	}
+
+	hosts := make([]string, 0, len(names))
+	for _, name := range names {
+		host := inventoryHost{name: name, vars: map[string]string{}}
+		for k, v := range vars[name] {
+			host.vars[k] = v
+		}
+		for k, v := range hostVars[name] {
+			host.vars[k] = v
+		}
+		hosts = append(hosts, host.String())
+	}
+	return hosts, nil
+}
+
+// String returns the host in the "user@host:port" form.
+func (h inventoryHost) String() string {
+	get := func(keys ...string) string {
+		for _, key := range keys {
+			if v := h.vars[key]; v != "" {
+				return v
+			}
+		}
+		return ""
+	}
+
+	host := h.name
+	if addr := get("ansible_host", "ansible_ssh_host"); addr != "" {
+		host = addr
+	}
+	if user := get("ansible_user", "ansible_ssh_user"); user != "" {
+		host = user + "@" + host
+	}
+	if port := get("ansible_port", "ansible_ssh_port"); port != "" {
+		host += ":" + port
+	}
+	return host
+}
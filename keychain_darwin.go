@@ -0,0 +1,16 @@
+package sup
+
+import (
+	"bytes"
+	"os/exec"
+)
+
+// keychainPassphrase returns the passphrase of the private key file stored
+// in the macOS Keychain, ie. by "ssh-add --apple-use-keychain".
+func keychainPassphrase(file string) ([]byte, bool) {
+	out, err := exec.Command("security", "find-generic-password", "-s", "OpenSSH", "-a", file, "-w").Output()
+	if err != nil {
+		return nil, false
+	}
+	return bytes.TrimRight(out, "\n"), true
+}
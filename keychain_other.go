@@ -0,0 +1,10 @@
+//go:build !darwin
+// +build !darwin
+
+package sup
+
+// keychainPassphrase returns the passphrase of the private key file. There's
+// no keychain to read it from outside of macOS.
+func keychainPassphrase(file string) ([]byte, bool) {
+	return nil, false
+}
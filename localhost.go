@@ -6,19 +6,28 @@ import (
 	"os"
 	"os/exec"
 	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/pkg/errors"
 )
 
 // Client is a wrapper over the SSH connection/sessions.
 type LocalhostClient struct {
+	mu      sync.Mutex // Guards running, ie. for Close during Wait.
 	cmd     *exec.Cmd
 	user    string
 	stdin   io.WriteCloser
-	stdout  io.Reader
-	stderr  io.Reader
+	stdout  *outputPipe
+	stderr  *outputPipe
 	running bool
 	env     string //export FOO="bar"; export BAR="baz";
+	command string // Command last started by Run.
+	color   string
+	state   string // Dir keeping the state of a persistent session, if any.
 }
 
 func (c *LocalhostClient) Connect(_ string) error {
@@ -34,29 +43,63 @@ func (c *LocalhostClient) Connect(_ string) error {
 func (c *LocalhostClient) Run(task *Task) error {
 	var err error
 
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	if c.running {
 		return fmt.Errorf("Command already running")
 	}
 
-	cmd := exec.Command("bash", "-c", c.env+task.Run)
+	run := c.env + task.Run
+	if c.state != "" {
+		run = persistentRun(c.state, c.env, task.Run)
+	}
+	args := []string{"-c", run}
+	if task.Login {
+		args = append([]string{"-l"}, args...)
+	}
+	shell := []string{"bash"}
+	if task.Shell != "" {
+		shell = strings.Fields(task.Shell)
+	}
+	cmd := exec.Command(shell[0], append(shell[1:], args...)...)
 	c.cmd = cmd
+	c.command = strings.Join(shell, " ")
+	if task.Login {
+		c.command += " -l"
+	}
+	c.command += " -c " + shellQuote(run)
 
-	c.stdout, err = cmd.StdoutPipe()
+	// Don't use cmd.StdoutPipe() and cmd.StderrPipe(), since cmd.Wait()
+	// closes them; the output is read concurrently and may outlive the command.
+	var stdoutW, stderrW *os.File
+	c.stdout, stdoutW, err = newOutputPipe()
 	if err != nil {
 		return err
 	}
-
-	c.stderr, err = cmd.StderrPipe()
+	c.stderr, stderrW, err = newOutputPipe()
 	if err != nil {
+		stdoutW.Close()
 		return err
 	}
+	cmd.Stdout = stdoutW
+	cmd.Stderr = stderrW
 
 	c.stdin, err = cmd.StdinPipe()
 	if err != nil {
 		return err
 	}
 
-	if err := c.cmd.Start(); err != nil {
+	err = c.cmd.Start()
+	// The child process has its own copies of the write ends now.
+	stdoutW.Close()
+	stderrW.Close()
+	if err != nil {
+		c.stdout.Close()
+		c.stderr.Close()
+		if e, ok := err.(*exec.Error); (ok && e.Err == exec.ErrNotFound) || os.IsNotExist(err) {
+			return ErrCommandNotFound{Host: c.Host(), Command: shell[0]}
+		}
 		return ErrTask{task, err.Error()}
 	}
 
@@ -65,16 +108,72 @@ func (c *LocalhostClient) Run(task *Task) error {
 }
 
 func (c *LocalhostClient) Wait() error {
+	c.mu.Lock()
 	if !c.running {
+		c.mu.Unlock()
 		return fmt.Errorf("Trying to wait on stopped command")
 	}
+	c.mu.Unlock()
+
 	err := c.cmd.Wait()
+	c.mu.Lock()
 	c.running = false
+	c.mu.Unlock()
+
+	// Background processes started by the command may still hold the output
+	// pipes open. Stop reading once the pipes go idle.
+	c.stdout.exited()
+	c.stderr.exited()
 	return err
 }
 
+// Close kills the running command, if any.
 func (c *LocalhostClient) Close() error {
-	return nil
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.running {
+		return nil
+	}
+	return c.cmd.Process.Kill()
+}
+
+// ErrCommandNotFound is returned by Run, if the shell to run the command
+// with isn't found on localhost. It fails the host without aborting the run,
+// like a failed command.
+type ErrCommandNotFound struct {
+	Host    string
+	Command string
+}
+
+func (e ErrCommandNotFound) Error() string {
+	return fmt.Sprintf("%v: command not found: %v", e.Host, e.Command)
+}
+
+// persistentRun wraps the command, so it starts in the working directory
+// and with the exported env vars the previous command of the session ended
+// with, and saves them for the next command on exit.
+func persistentRun(state, env, run string) string {
+	dir := shellQuote(filepath.Join(state, "pwd"))
+	vars := shellQuote(filepath.Join(state, "env"))
+	return `if [ -f ` + vars + ` ]; then . ` + vars + `; cd "$(cat ` + dir + `)"; fi; ` + env +
+		`trap ` + shellQuote(`pwd > `+dir+`; export -p > `+vars) + ` EXIT; ` + run
+}
+
+func (c *LocalhostClient) Host() string {
+	return "localhost"
+}
+
+// Command returns the final command string last started by Run, including
+// the exported environment variables and the shell.
+func (c *LocalhostClient) Command() string {
+	return c.command
+}
+
+// appendEnv exports the env vars of the export statements to the
+// subsequent commands, see Stackup.register.
+func (c *LocalhostClient) appendEnv(exports string) {
+	c.env += exports
 }
 
 func (c *LocalhostClient) Stdin() io.WriteCloser {
@@ -91,7 +190,7 @@ func (c *LocalhostClient) Stdout() io.Reader {
 
 func (c *LocalhostClient) Prefix() (string, int) {
 	host := c.user + "@localhost" + " | "
-	return ResetColor + host, len(host)
+	return colorize(c.color, host), len(host)
 }
 
 func (c *LocalhostClient) Write(p []byte) (n int, err error) {
@@ -103,9 +202,57 @@ func (c *LocalhostClient) WriteClose() error {
 }
 
 func (c *LocalhostClient) Signal(sig os.Signal) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.running {
+		return fmt.Errorf("command is not running")
+	}
 	return c.cmd.Process.Signal(sig)
 }
 
+// outputIdleTimeout is how long the output of an exited command is read
+// before giving up on processes that inherited the output pipes.
+const outputIdleTimeout = time.Second
+
+// outputPipe is the read end of a command's output pipe. After the command
+// exits, it reports EOF once there's no output for outputIdleTimeout.
+type outputPipe struct {
+	r    *os.File
+	done int32
+}
+
+func newOutputPipe() (*outputPipe, *os.File, error) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	return &outputPipe{r: r}, w, nil
+}
+
+func (p *outputPipe) exited() {
+	atomic.StoreInt32(&p.done, 1)
+	p.r.SetReadDeadline(time.Now().Add(outputIdleTimeout))
+}
+
+func (p *outputPipe) Read(b []byte) (int, error) {
+	if atomic.LoadInt32(&p.done) == 1 {
+		p.r.SetReadDeadline(time.Now().Add(outputIdleTimeout))
+	}
+	n, err := p.r.Read(b)
+	if err != nil && os.IsTimeout(err) {
+		err = io.EOF
+	}
+	if err == io.EOF {
+		p.r.Close()
+	}
+	return n, err
+}
+
+func (p *outputPipe) Close() error {
+	return p.r.Close()
+}
+
 func ResolveLocalPath(cwd, path, env string) (string, error) {
 	// Check if file exists first. Use bash to resolve $ENV_VARs.
 	cmd := exec.Command("bash", "-c", env+"echo -n "+path)
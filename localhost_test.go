@@ -0,0 +1,26 @@
+package sup
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLocalhostLingeringOutput(t *testing.T) {
+	sup, err := New(&Supfile{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	local := &LocalhostClient{}
+	if err := local.Connect("localhost"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The background process inherits the output of the command.
+	start := time.Now()
+	if err := sup.runTask(&Task{Run: "sleep 5 & echo started", Clients: []Client{local}}, "lingering", 0, false); err != nil {
+		t.Fatal(err)
+	}
+	if took := time.Since(start); took > 3*time.Second {
+		t.Errorf("task took %v, waited for the background process", took)
+	}
+}
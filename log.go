@@ -0,0 +1,69 @@
+package sup
+
+import (
+	"fmt"
+	"os"
+)
+
+// LogLevel is the severity of a LogEntry.
+type LogLevel int
+
+const (
+	LogInfo LogLevel = iota
+	LogWarn
+	LogError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogWarn:
+		return "warn"
+	case LogError:
+		return "error"
+	default:
+		return "info"
+	}
+}
+
+// LogEntry is a diagnostic message of sup itself, ie. a failed command
+// or an interrupt. Output of the commands isn't logged; it's streamed
+// to STDOUT and STDERR as is.
+type LogEntry struct {
+	Level   LogLevel
+	Message string // Message, as printed to STDERR by default.
+	Host    string // Host the entry relates to, if any.
+	Command string // Command the entry relates to, if any.
+	Err     error  // Error the entry reports, if any.
+}
+
+// Logger receives the diagnostic messages of Stackup, ie. to route them
+// to the logger of the service sup is embedded in.
+type Logger interface {
+	Log(e LogEntry)
+}
+
+// LoggerFunc adapts a function to the Logger interface.
+type LoggerFunc func(e LogEntry)
+
+func (f LoggerFunc) Log(e LogEntry) {
+	f(e)
+}
+
+// StderrLogger prints the messages to STDERR, one per line. It's used
+// by default.
+var StderrLogger Logger = LoggerFunc(func(e LogEntry) {
+	fmt.Fprintln(os.Stderr, e.Message)
+})
+
+// Logger sets the logger of diagnostic messages, StderrLogger by default.
+func (sup *Stackup) Logger(l Logger) {
+	sup.logger = l
+}
+
+func (sup *Stackup) log(e LogEntry) {
+	if sup.logger == nil {
+		StderrLogger.Log(e)
+		return
+	}
+	sup.logger.Log(e)
+}
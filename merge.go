@@ -0,0 +1,92 @@
+package sup
+
+// Merge merges the other Supfile into the Supfile, ie. project commands
+// into a Supfile of shared networks. Networks, commands and targets of the
+// other Supfile replace the ones of the same name as a whole, keeping their
+// position in the listings, and the new ones are appended. A command
+// replaces a target of the same name, and vice versa. Env vars are combined
+// the same way, the other's values override. Non-empty settings of the
+// other Supfile, ie. default_network, override.
+func (conf *Supfile) Merge(other *Supfile) {
+	for _, name := range other.Networks.Names {
+		if conf.Networks.nets == nil {
+			conf.Networks.nets = map[string]Network{}
+		}
+		if _, ok := conf.Networks.nets[name]; !ok {
+			conf.Networks.Names = append(conf.Networks.Names, name)
+		}
+		conf.Networks.nets[name] = other.Networks.nets[name]
+	}
+
+	for _, name := range other.Commands.Names {
+		if conf.Commands.cmds == nil {
+			conf.Commands.cmds = map[string]Command{}
+		}
+		if _, ok := conf.Commands.cmds[name]; !ok {
+			conf.Commands.Names = append(conf.Commands.Names, name)
+		}
+		conf.Commands.cmds[name] = other.Commands.cmds[name]
+		conf.Targets.remove(name)
+	}
+
+	for _, name := range other.Targets.Names {
+		if conf.Targets.targets == nil {
+			conf.Targets.targets = map[string][]string{}
+		}
+		if _, ok := conf.Targets.targets[name]; !ok {
+			conf.Targets.Names = append(conf.Targets.Names, name)
+		}
+		conf.Targets.targets[name] = other.Targets.targets[name]
+		conf.Commands.remove(name)
+	}
+
+	for _, v := range other.Env {
+		conf.Env.Set(v.Key, v.Value)
+	}
+
+	if other.Version != "" {
+		conf.Version = other.Version
+	}
+	if other.MinVersion != "" {
+		if older, err := versionLess(conf.MinVersion, other.MinVersion); conf.MinVersion == "" || (err == nil && older) {
+			conf.MinVersion = other.MinVersion
+		}
+	}
+	if other.DefaultNetwork != "" {
+		conf.DefaultNetwork = other.DefaultNetwork
+	}
+	if other.DefaultCommand != "" {
+		conf.DefaultCommand = other.DefaultCommand
+	}
+	if len(other.Facts) > 0 {
+		conf.Facts = other.Facts
+	}
+}
+
+// remove removes the command, if defined.
+func (c *Commands) remove(name string) {
+	if _, ok := c.cmds[name]; !ok {
+		return
+	}
+	delete(c.cmds, name)
+	c.Names = removeName(c.Names, name)
+}
+
+// remove removes the target, if defined.
+func (t *Targets) remove(name string) {
+	if _, ok := t.targets[name]; !ok {
+		return
+	}
+	delete(t.targets, name)
+	t.Names = removeName(t.Names, name)
+}
+
+func removeName(names []string, name string) []string {
+	var kept []string
+	for _, n := range names {
+		if n != name {
+			kept = append(kept, n)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,115 @@
+package sup
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// MetricsBuckets are the upper bounds (in seconds) of the command duration
+// histogram buckets.
+var MetricsBuckets = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 600, 1800, 3600}
+
+type metricsKey struct {
+	command string
+	host    string
+}
+
+type metricsValue struct {
+	success  int
+	failure  int
+	buckets  []int
+	count    int
+	sum      float64
+	lastTime int64
+}
+
+// WriteMetrics writes the results in the Prometheus text exposition format,
+// suitable for the node_exporter textfile collector. The metrics are
+// labeled by network, command and host:
+//
+//	sup_command_runs_total{network,command,host,status="success|failure"}
+//	sup_command_duration_seconds{network,command,host} (histogram)
+//	sup_command_last_run_timestamp_seconds{network,command,host}
+func WriteMetrics(w io.Writer, network string, results []Result) error {
+	values := map[metricsKey]*metricsValue{}
+	var keys []metricsKey
+	for _, res := range results {
+		key := metricsKey{res.Command, res.Host}
+		v, ok := values[key]
+		if !ok {
+			v = &metricsValue{buckets: make([]int, len(MetricsBuckets))}
+			values[key] = v
+			keys = append(keys, key)
+		}
+
+		if res.ExitCode == 0 {
+			v.success++
+		} else {
+			v.failure++
+		}
+		duration := res.End.Sub(res.Start).Seconds()
+		for i, le := range MetricsBuckets {
+			if duration <= le {
+				v.buckets[i]++
+			}
+		}
+		v.count++
+		v.sum += duration
+		if t := res.End.Unix(); t > v.lastTime {
+			v.lastTime = t
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].command != keys[j].command {
+			return keys[i].command < keys[j].command
+		}
+		return keys[i].host < keys[j].host
+	})
+
+	labels := func(key metricsKey, extra ...string) string {
+		l := []string{
+			`network="` + escapeLabel(network) + `"`,
+			`command="` + escapeLabel(key.command) + `"`,
+			`host="` + escapeLabel(key.host) + `"`,
+		}
+		return "{" + strings.Join(append(l, extra...), ",") + "}"
+	}
+
+	var b strings.Builder
+	b.WriteString("# HELP sup_command_runs_total Number of command runs per host by status.\n")
+	b.WriteString("# TYPE sup_command_runs_total counter\n")
+	for _, key := range keys {
+		v := values[key]
+		fmt.Fprintf(&b, "sup_command_runs_total%v %v\n", labels(key, `status="success"`), v.success)
+		fmt.Fprintf(&b, "sup_command_runs_total%v %v\n", labels(key, `status="failure"`), v.failure)
+	}
+
+	b.WriteString("# HELP sup_command_duration_seconds Duration of command runs per host.\n")
+	b.WriteString("# TYPE sup_command_duration_seconds histogram\n")
+	for _, key := range keys {
+		v := values[key]
+		for i, le := range MetricsBuckets {
+			fmt.Fprintf(&b, "sup_command_duration_seconds_bucket%v %v\n", labels(key, `le="`+strconv.FormatFloat(le, 'g', -1, 64)+`"`), v.buckets[i])
+		}
+		fmt.Fprintf(&b, "sup_command_duration_seconds_bucket%v %v\n", labels(key, `le="+Inf"`), v.count)
+		fmt.Fprintf(&b, "sup_command_duration_seconds_sum%v %v\n", labels(key), strconv.FormatFloat(v.sum, 'f', -1, 64))
+		fmt.Fprintf(&b, "sup_command_duration_seconds_count%v %v\n", labels(key), v.count)
+	}
+
+	b.WriteString("# HELP sup_command_last_run_timestamp_seconds Time the command last finished per host.\n")
+	b.WriteString("# TYPE sup_command_last_run_timestamp_seconds gauge\n")
+	for _, key := range keys {
+		fmt.Fprintf(&b, "sup_command_last_run_timestamp_seconds%v %v\n", labels(key), values[key].lastTime)
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// escapeLabel escapes a Prometheus label value.
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
@@ -0,0 +1,155 @@
+package sup
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+var (
+	mockHostKeyOnce sync.Once
+	mockHostKey     ssh.Signer
+)
+
+// mockHandler replies to the command of an exec request. It writes the
+// output to the channel and sends the exit status by mockExit. The server
+// closes the channel once the handler returns.
+type mockHandler func(command string, ch ssh.Channel)
+
+// mockServer is an SSH server for tests. It doesn't run any commands, the
+// handler replies to them instead.
+type mockServer struct {
+	addr     string
+	config   *ssh.ServerConfig
+	handler  mockHandler
+	listener net.Listener
+}
+
+// newMockServer starts a mock server listening on a random port of
+// 127.0.0.1, until the test ends. Clients authenticate without any
+// credentials, unless the config says otherwise. Commands succeed without
+// any output, if the handler is nil.
+func newMockServer(tb testing.TB, config *ssh.ServerConfig, handler mockHandler) *mockServer {
+	tb.Helper()
+	mockHostKeyOnce.Do(func() {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			panic(err)
+		}
+		mockHostKey, err = ssh.NewSignerFromKey(key)
+		if err != nil {
+			panic(err)
+		}
+	})
+	if config == nil {
+		config = &ssh.ServerConfig{NoClientAuth: true}
+	}
+	config.AddHostKey(mockHostKey)
+	if handler == nil {
+		handler = func(command string, ch ssh.Channel) {
+			mockExit(ch, 0)
+		}
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	s := &mockServer{
+		addr:     l.Addr().String(),
+		config:   config,
+		handler:  handler,
+		listener: l,
+	}
+	tb.Cleanup(func() { l.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *mockServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.serveConn(conn)
+	}
+}
+
+func (s *mockServer) serveConn(conn net.Conn) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newCh := range chans {
+		if newCh.ChannelType() != "session" {
+			newCh.Reject(ssh.UnknownChannelType, "only sessions are supported")
+			continue
+		}
+		ch, chReqs, err := newCh.Accept()
+		if err != nil {
+			continue
+		}
+		go s.serveSession(ch, chReqs)
+	}
+}
+
+func (s *mockServer) serveSession(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	for req := range reqs {
+		switch req.Type {
+		case "exec":
+			var exec struct{ Command string }
+			if err := ssh.Unmarshal(req.Payload, &exec); err != nil {
+				req.Reply(false, nil)
+				continue
+			}
+			req.Reply(true, nil)
+			go func() {
+				s.handler(exec.Command, ch)
+				ch.Close()
+			}()
+		case "pty-req", "env":
+			req.Reply(true, nil)
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+// mockExit sends the exit status of the command.
+func mockExit(ch ssh.Channel, status uint32) {
+	ch.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+}
+
+// mockHome sets $HOME to a temporary directory, whose known_hosts file has
+// the host key of the mock servers, and unsets $SSH_AUTH_SOCK, so the user's
+// own keys and known hosts aren't used.
+func mockHome(tb testing.TB, servers ...*mockServer) {
+	tb.Helper()
+	home := tb.TempDir()
+	var lines []string
+	for _, s := range servers {
+		lines = append(lines, knownhosts.Line([]string{knownhosts.Normalize(s.addr)}, mockHostKey.PublicKey()))
+	}
+	if err := os.Mkdir(filepath.Join(home, ".ssh"), 0700); err != nil {
+		tb.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(home, ".ssh", "known_hosts"), []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		tb.Fatal(err)
+	}
+	tb.Setenv("HOME", home)
+	tb.Setenv("SSH_AUTH_SOCK", "")
+}
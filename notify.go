@@ -0,0 +1,216 @@
+package sup
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// NotifyTimeout limits how long Notify waits for the webhook.
+var NotifyTimeout = 10 * time.Second
+
+// Summary is the outcome of a run, as posted by Notify.
+type Summary struct {
+	Network  string          `json:"network"`
+	Commands []string        `json:"commands"`
+	Success  bool            `json:"success"`
+	Error    string          `json:"error,omitempty"`
+	Start    time.Time       `json:"start"`
+	End      time.Time       `json:"end"`
+	Results  []SummaryResult `json:"results"`
+}
+
+// SummaryResult is the outcome of a command on a single host.
+type SummaryResult struct {
+	Host      string  `json:"host"`
+	Command   string  `json:"command"`
+	ExitCode  int     `json:"exit_code"`
+	Ignored   bool    `json:"ignored,omitempty"`
+	Cancelled bool    `json:"cancelled,omitempty"`
+	TimedOut  bool    `json:"timed_out,omitempty"`
+	Error     string  `json:"error,omitempty"`
+	Unchanged bool    `json:"unchanged,omitempty"` // Skipped by run_if_changed.
+	Stdout    string  `json:"stdout,omitempty"`    // Tail of the output of a timed out command.
+	Stderr    string  `json:"stderr,omitempty"`    // Tail of the output of a timed out command.
+	Duration  float64 `json:"duration_seconds"`
+}
+
+// NewSummary summarizes the results of a run, which ended with err.
+func NewSummary(network string, commands []string, start time.Time, results []Result, err error) Summary {
+	s := Summary{
+		Network:  network,
+		Commands: commands,
+		Success:  err == nil,
+		Start:    start,
+		End:      time.Now(),
+		Results:  []SummaryResult{},
+	}
+	if err != nil {
+		s.Error = err.Error()
+	}
+	for _, res := range results {
+		r := SummaryResult{
+			Host:      res.Host,
+			Command:   res.Command,
+			ExitCode:  res.ExitCode,
+			Ignored:   res.Ignored,
+			Cancelled: res.Cancelled,
+			TimedOut:  res.TimedOut,
+			Error:     res.Error,
+			Unchanged: res.Unchanged,
+			Duration:  res.End.Sub(res.Start).Seconds(),
+		}
+		if res.TimedOut {
+			r.Stdout, r.Stderr = string(res.Stdout), string(res.Stderr)
+		}
+		s.Results = append(s.Results, r)
+	}
+	return s
+}
+
+// Duration returns how long the run took.
+func (s Summary) Duration() time.Duration {
+	return s.End.Sub(s.Start).Round(time.Millisecond)
+}
+
+// Failed returns the number of failed command runs.
+func (s Summary) Failed() int {
+	n := 0
+	for _, res := range s.Results {
+		if res.ExitCode != 0 && !res.Cancelled {
+			n++
+		}
+	}
+	return n
+}
+
+// Cancelled returns the hosts cancelled during the run.
+func (s Summary) Cancelled() []string {
+	var hosts []string
+	seen := map[string]bool{}
+	for _, res := range s.Results {
+		if res.Cancelled && !seen[res.Host] {
+			seen[res.Host] = true
+			hosts = append(hosts, res.Host)
+		}
+	}
+	return hosts
+}
+
+// TimedOut returns the hosts the commands timed out on.
+func (s Summary) TimedOut() []string {
+	var hosts []string
+	seen := map[string]bool{}
+	for _, res := range s.Results {
+		if res.TimedOut && !seen[res.Host] {
+			seen[res.Host] = true
+			hosts = append(hosts, res.Host)
+		}
+	}
+	return hosts
+}
+
+// Unchanged returns "command: host" of the commands skipped by
+// run_if_changed, since their upload didn't change anything on the host.
+func (s Summary) Unchanged() []string {
+	var skipped []string
+	for _, res := range s.Results {
+		if res.Unchanged {
+			skipped = append(skipped, res.Command+": "+res.Host)
+		}
+	}
+	return skipped
+}
+
+// DefaultNotifyTemplate is the message of Notify, if no template is given.
+const DefaultNotifyTemplate = `sup {{if .Success}}succeeded{{else}}failed{{end}}: {{join .Commands " "}} on {{.Network}} in {{.Duration}}` +
+	`{{if .Failed}} ({{.Failed}} of {{len .Results}} command runs failed){{end}}` +
+	`{{with .Cancelled}} (cancelled on {{join . ", "}}){{end}}{{with .TimedOut}} (timed out on {{join . ", "}}){{end}}` +
+	`{{with .Unchanged}} (unchanged, skipped {{join . ", "}}){{end}}` +
+	`{{if .Error}}: {{.Error}}{{end}}`
+
+// Notify posts the summary to the webhook URL. The message is rendered
+// from the text/template tmpl, or DefaultNotifyTemplate, if empty. The
+// "slack" format posts just the message as a Slack-compatible payload,
+// the "json" format posts the whole summary along with the message.
+func Notify(url, format, tmpl string, s Summary) error {
+	t, err := notifyTemplate(tmpl)
+	if err != nil {
+		return err
+	}
+	var msg bytes.Buffer
+	if err := t.Execute(&msg, s); err != nil {
+		return errors.Wrap(err, "rendering template failed")
+	}
+
+	var payload interface{}
+	switch format {
+	case "", "json":
+		payload = struct {
+			Summary
+			Message string `json:"message"`
+		}{s, msg.String()}
+	case "slack":
+		payload = map[string]string{"text": msg.String()}
+	default:
+		return errNotifyFormat(format)
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: NotifyTimeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%v responded with %v", url, resp.Status)
+	}
+	return nil
+}
+
+// CheckNotify checks the format and the template of Notify, ie. before
+// the run, so they don't fail only once it's over. The template is
+// rendered with an empty summary, to catch unknown fields.
+func CheckNotify(format, tmpl string) error {
+	switch format {
+	case "", "json", "slack":
+	default:
+		return errNotifyFormat(format)
+	}
+	t, err := notifyTemplate(tmpl)
+	if err != nil {
+		return err
+	}
+	if err := t.Execute(ioutil.Discard, Summary{}); err != nil {
+		return errors.Wrap(err, "rendering template failed")
+	}
+	return nil
+}
+
+// notifyTemplate parses the template of Notify, or DefaultNotifyTemplate,
+// if empty.
+func notifyTemplate(tmpl string) (*template.Template, error) {
+	if tmpl == "" {
+		tmpl = DefaultNotifyTemplate
+	}
+	t, err := template.New("notify").Funcs(template.FuncMap{"join": strings.Join}).Parse(tmpl)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing template failed")
+	}
+	return t, nil
+}
+
+func errNotifyFormat(format string) error {
+	return fmt.Errorf("unknown format %q, expected json or slack", format)
+}
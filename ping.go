@@ -0,0 +1,27 @@
+package sup
+
+// HostPing is the result of connecting to a single host.
+type HostPing struct {
+	Host string
+	Err  error // Connecting failed, the host is unreachable.
+}
+
+// Ping connects to all the hosts of the network, through their bastions
+// and ProxyCommands, without running any commands, and closes the
+// connections right away. The results are returned in the order of hosts.
+func (sup *Stackup) Ping(network *Network, envVars EnvList) ([]HostPing, error) {
+	defer sup.closeBastions()
+	clients, errs, err := sup.dial(network, envVars.AsExport(), "")
+	if err != nil {
+		return nil, err
+	}
+
+	pings := make([]HostPing, len(network.Hosts))
+	for i, host := range network.Hosts {
+		pings[i] = HostPing{Host: host, Err: errs[i]}
+		if clients[i] != nil {
+			clients[i].Close()
+		}
+	}
+	return pings, nil
+}
@@ -0,0 +1,123 @@
+package sup
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// pipelined reports whether the command's tasks can be run as independent
+// per-host pipelines, ie. each host runs the command as soon as its own
+// upload finishes, instead of waiting for the uploads to all the hosts.
+// This requires all the tasks to run on the same set of clients and not
+// to share STDIN of the sup process.
+func (sup *Stackup) pipelined(cmd *Command, tasks []*Task) bool {
+	if len(cmd.Upload) == 0 || len(tasks) < 2 {
+		return false
+	}
+	if cmd.Stdin || cmd.Local != "" || cmd.Once || cmd.Serial > 0 || cmd.GroupSerial > 0 || len(cmd.Batches) > 0 || cmd.MaxUnavailable != "" || cmd.Healthcheck != nil || cmd.Drain != nil {
+		return false
+	}
+	for _, task := range tasks {
+		if len(task.Clients) != len(tasks[0].Clients) {
+			return false
+		}
+	}
+	return true
+}
+
+// runPipeline runs the tasks sequentially on each client, but independently
+// of the other clients. The input of each task is split, so every client
+// reads its own copy of it.
+func (sup *Stackup) runPipeline(tasks []*Task, name string, maxLen int, raw bool) error {
+	clients := tasks[0].Clients
+
+	inputs := make([][]*io.PipeReader, len(tasks))
+	for i, task := range tasks {
+		if task.Input != nil {
+			inputs[i] = sup.splitReader(task.Input, len(clients))
+		}
+	}
+
+	var (
+		wg       sync.WaitGroup
+		errMu    sync.Mutex
+		firstErr error
+	)
+	for j, c := range clients {
+		wg.Add(1)
+		go func(j int, c Client) {
+			defer wg.Done()
+			for i, task := range tasks {
+				t := *task
+				t.Clients = []Client{c}
+				if inputs[i] != nil {
+					t.Input = inputs[i][j]
+				}
+
+				if err := sup.runTask(&t, name, maxLen, raw); err != nil {
+					if t.step != "" {
+						sup.log(LogEntry{Level: LogError, Message: fmt.Sprintf("%v: %v: %v failed", clientHost(c), name, t.step), Host: clientHost(c), Command: name, Err: err})
+					}
+					// Unblock the inputs this client won't read anymore.
+					for _, input := range inputs[i:] {
+						if input != nil {
+							input[j].CloseWithError(errors.New("pipeline aborted"))
+						}
+					}
+					errMu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					errMu.Unlock()
+					return
+				}
+			}
+		}(j, c)
+	}
+	wg.Wait()
+
+	return firstErr
+}
+
+// splitReader returns n readers, each reading a copy of r.
+func (sup *Stackup) splitReader(r io.Reader, n int) []*io.PipeReader {
+	readers := make([]*io.PipeReader, n)
+	writers := make([]*io.PipeWriter, n)
+	for i := range readers {
+		readers[i], writers[i] = io.Pipe()
+	}
+
+	go func() {
+		buf := make([]byte, 32*1024)
+		for {
+			nr, err := r.Read(buf)
+			if nr > 0 {
+				for i, w := range writers {
+					if w == nil {
+						continue
+					}
+					// Stop writing to readers that were closed.
+					if _, err := w.Write(buf[:nr]); err != nil {
+						writers[i] = nil
+					}
+				}
+			}
+			if err != nil {
+				if err != io.EOF {
+					sup.log(LogEntry{Level: LogError, Message: errors.Wrap(err, "reading input failed").Error(), Err: err})
+				}
+				for _, w := range writers {
+					if w != nil {
+						w.CloseWithError(err)
+					}
+				}
+				return
+			}
+		}
+	}()
+
+	return readers
+}
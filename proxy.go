@@ -0,0 +1,119 @@
+package sup
+
+import (
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/ssh"
+)
+
+// proxyCommand returns the ProxyCommand to connect to the host through, if any.
+func (n Network) proxyCommand(host string) string {
+	if command, ok := n.HostProxyCommand[host]; ok {
+		return command
+	}
+	return n.ProxyCommand
+}
+
+// ProxyCommandDialer returns an SSHDialFunc connecting through STDIN and
+// STDOUT of the local command, like ssh_config's ProxyCommand. The %h,
+// %p and %r tokens of the command are expanded to the host, port and
+// remote user, and %% to a literal "%".
+func ProxyCommandDialer(command string) SSHDialFunc {
+	return func(network, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		command := expandProxyTokens(command, host, port, config.User)
+
+		cmd := exec.Command("/bin/sh", "-c", command)
+		cmd.Stderr = os.Stderr
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			return nil, err
+		}
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			return nil, err
+		}
+		if err := cmd.Start(); err != nil {
+			return nil, errors.Wrap(err, "starting ProxyCommand failed")
+		}
+
+		conn := &proxyConn{cmd: cmd, stdin: stdin, stdout: stdout, addr: proxyAddr(addr)}
+		c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+		if err != nil {
+			conn.Close()
+			return nil, errors.Wrapf(err, "connecting through ProxyCommand %q failed", command)
+		}
+		return ssh.NewClient(c, chans, reqs), nil
+	}
+}
+
+// expandProxyTokens expands the %h, %p, %r and %% tokens of the command.
+func expandProxyTokens(command, host, port, user string) string {
+	var b strings.Builder
+	for i := 0; i < len(command); i++ {
+		if command[i] != '%' || i+1 == len(command) {
+			b.WriteByte(command[i])
+			continue
+		}
+		i++
+		switch command[i] {
+		case 'h':
+			b.WriteString(host)
+		case 'p':
+			b.WriteString(port)
+		case 'r':
+			b.WriteString(user)
+		case '%':
+			b.WriteByte('%')
+		default: // Unknown token, keep it as is.
+			b.WriteByte('%')
+			b.WriteByte(command[i])
+		}
+	}
+	return b.String()
+}
+
+// proxyConn is a net.Conn over STDIN and STDOUT of a ProxyCommand.
+type proxyConn struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.Reader
+	addr   proxyAddr
+
+	closeOnce sync.Once // The SSH connection may close it more than once.
+	closeErr  error
+}
+
+func (c *proxyConn) Read(b []byte) (int, error)  { return c.stdout.Read(b) }
+func (c *proxyConn) Write(b []byte) (int, error) { return c.stdin.Write(b) }
+
+func (c *proxyConn) Close() error {
+	c.closeOnce.Do(func() {
+		c.stdin.Close()
+		c.cmd.Process.Kill()
+		c.closeErr = c.cmd.Wait()
+	})
+	return c.closeErr
+}
+
+func (c *proxyConn) LocalAddr() net.Addr                { return proxyAddr("localhost:0") }
+func (c *proxyConn) RemoteAddr() net.Addr               { return c.addr }
+func (c *proxyConn) SetDeadline(t time.Time) error      { return nil }
+func (c *proxyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *proxyConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// proxyAddr is the "host:port" address connected to through a ProxyCommand.
+type proxyAddr string
+
+func (a proxyAddr) Network() string { return "proxy" }
+func (a proxyAddr) String() string  { return string(a) }
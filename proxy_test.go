@@ -0,0 +1,105 @@
+package sup
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestExpandProxyTokens(t *testing.T) {
+	tests := []struct {
+		command string
+		want    string
+	}{
+		{"nc %h 22", "nc example.com 22"},
+		{"nc bastion %p", "nc bastion 2222"},
+		{"ssh -l %r bastion", "ssh -l deploy bastion"},
+		{"echo 100%%", "echo 100%"},
+		{"echo %%h", "echo %h"},
+		{"echo %x", "echo %x"},
+		{"echo %", "echo %"},
+		{"ssh -W %h:%p %r@bastion", "ssh -W example.com:2222 deploy@bastion"},
+	}
+	for _, tt := range tests {
+		if got := expandProxyTokens(tt.command, "example.com", "2222", "deploy"); got != tt.want {
+			t.Errorf("expandProxyTokens(%q) = %q, want %q", tt.command, got, tt.want)
+		}
+	}
+}
+
+// TestProxyHelper isn't a test, it's the ProxyCommand of
+// TestProxyCommandDialer. It relays its STDIN and STDOUT to the address of
+// $SUP_TEST_PROXY.
+func TestProxyHelper(t *testing.T) {
+	addr := os.Getenv("SUP_TEST_PROXY")
+	if addr == "" {
+		return
+	}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		os.Exit(1)
+	}
+	go io.Copy(conn, os.Stdin)
+	io.Copy(os.Stdout, conn)
+	os.Exit(0)
+}
+
+func TestProxyCommandDialer(t *testing.T) {
+	s := newMockServer(t, nil, nil)
+	_, port, err := net.SplitHostPort(s.addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		want  string
+	}{
+		{"host", "%h", "127.0.0.1"},
+		{"port", "%p", port},
+		{"user", "%r", "deploy"},
+		{"percent", "%%", "%"},
+		{"unknown", "%x", "%x"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The command writes the expanded token, and connects to the
+			// host and port of its own tokens.
+			out := filepath.Join(t.TempDir(), "token")
+			command := "printf '%s' '" + tt.token + "' > " + out +
+				"; SUP_TEST_PROXY=%h:%p exec " + os.Args[0] + " -test.run='^TestProxyHelper$'"
+
+			config := &ssh.ClientConfig{
+				User:            "deploy",
+				HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+			}
+			client, err := ProxyCommandDialer(command)("tcp", s.addr, config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+
+			sess, err := client.NewSession()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := sess.Run("true"); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := ioutil.ReadFile(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("%v expanded to %q, want %q", tt.token, got, tt.want)
+			}
+		})
+	}
+}
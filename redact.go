@@ -0,0 +1,56 @@
+package sup
+
+import (
+	"bytes"
+	"regexp"
+)
+
+// SecretEnvPattern matches names of env vars whose values are redacted
+// from archives and audit logs, see Redactor.
+var SecretEnvPattern = regexp.MustCompile(`(?i)pass|secret|token|key|credential|auth|private`)
+
+// Redacted replaces the redacted values.
+const Redacted = "[REDACTED]"
+
+// minSecretLen is the length of the shortest secret value redacted from
+// any data, so ie. "1" doesn't redact every digit.
+const minSecretLen = 4
+
+// exportStatement matches the export statements of env vars in commands,
+// see EnvVar.AsExport, including the single-quoted values quoted again
+// within the single-quoted command of the shell, see remoteCommand.
+var exportStatement = regexp.MustCompile(`(export ([A-Za-z_][A-Za-z0-9_]*)=)('\\''[^']*'\\''|"(?:[^"\\]|\\.)*"|'[^']*'|[^;\s]*)`)
+
+// Redactor redacts secrets, the values of the env vars matching
+// SecretEnvPattern, from any data, ie. output of the hosts. It redacts
+// values exported by commands to the env vars matching SecretEnvPattern
+// as well, ie. of host_env.
+type Redactor struct {
+	secrets [][]byte
+}
+
+// NewRedactor returns a Redactor of the env's secrets.
+func NewRedactor(env EnvList) *Redactor {
+	r := &Redactor{}
+	for _, v := range env {
+		if SecretEnvPattern.MatchString(v.Key) && len(v.Value) >= minSecretLen {
+			r.secrets = append(r.secrets, []byte(v.Value))
+		}
+	}
+	return r
+}
+
+// Redact returns the data with the secrets replaced by Redacted.
+func (r *Redactor) Redact(data []byte) []byte {
+	data = exportStatement.ReplaceAllFunc(data, func(export []byte) []byte {
+		m := exportStatement.FindSubmatch(export)
+		if !SecretEnvPattern.Match(m[2]) {
+			return export
+		}
+		return append(append([]byte{}, m[1]...), Redacted...)
+	})
+	for _, secret := range r.secrets {
+		data = bytes.Replace(data, secret, []byte(Redacted), -1)
+	}
+	return data
+}
@@ -0,0 +1,43 @@
+package sup
+
+import "strings"
+
+// register exports the variable in the env of the client's subsequent
+// commands, including the ones run on new connections to the same host.
+func (sup *Stackup) register(c Client, name, value string) {
+	if sup.noEnv {
+		return
+	}
+	export := `export ` + name + `=` + shellQuote(value) + `;`
+	if c, ok := c.(envAppender); ok {
+		c.appendEnv(export)
+	}
+
+	sup.registeredMu.Lock()
+	defer sup.registeredMu.Unlock()
+	if sup.registered == nil {
+		sup.registered = map[string]string{}
+	}
+	sup.registered[hostKey(clientHost(c))] += export
+}
+
+// envAppender is a client whose env can be appended to, ie. SSHClient.
+type envAppender interface {
+	appendEnv(exports string)
+}
+
+// registeredEnv returns the exports of the variables registered on the host.
+func (sup *Stackup) registeredEnv(host string) string {
+	sup.registeredMu.Lock()
+	defer sup.registeredMu.Unlock()
+	return sup.registered[hostKey(host)]
+}
+
+// hostKey returns the host without the user, so connections to the host
+// as different users are treated as the same host.
+func hostKey(host string) string {
+	if at := strings.LastIndex(host, "@"); at != -1 {
+		return host[at+1:]
+	}
+	return host
+}
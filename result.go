@@ -0,0 +1,226 @@
+package sup
+
+import (
+	"bytes"
+	"io"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Result represents the outcome of a command run on a single host.
+type Result struct {
+	Host      string
+	Command   string
+	Resolved  string // Final command string sent to the host.
+	Stdout    []byte // Captured by RunOn, or the tail of it, if the command timed out.
+	Stderr    []byte // Captured by RunOn, or the tail of it, if the command timed out.
+	ExitCode  int    // -1, if the command didn't exit normally.
+	Ignored   bool   // The command failed, but it ignores errors.
+	Cancelled bool   // The command was aborted by CancelHost.
+	TimedOut  bool   // The command was aborted, because the run exceeded its deadline.
+	Error     string // Why the command couldn't be started at all, ie. it wasn't found.
+	Unchanged bool   // The command was skipped, its run_if_changed upload didn't change anything.
+	Start     time.Time
+	End       time.Time
+}
+
+// Option configures RunOn.
+type Option func(*runOnOptions)
+
+type runOnOptions struct {
+	env     EnvList
+	user    string
+	bastion string
+	input   io.Reader
+	tty     bool
+
+	insecureIgnoreHostKey bool
+}
+
+// WithEnv sets environment variables exported before the command is run.
+func WithEnv(env EnvList) Option {
+	return func(o *runOnOptions) {
+		o.env = env
+	}
+}
+
+// WithUser sets the SSH user, unless the host is of the "user@host" form.
+func WithUser(user string) Option {
+	return func(o *runOnOptions) {
+		o.user = user
+	}
+}
+
+// WithBastion connects to the host through the given jump host.
+func WithBastion(bastion string) Option {
+	return func(o *runOnOptions) {
+		o.bastion = bastion
+	}
+}
+
+// WithInput attaches the reader to the command's STDIN.
+func WithInput(r io.Reader) Option {
+	return func(o *runOnOptions) {
+		o.input = r
+	}
+}
+
+// WithTTY requests a pseudo terminal for the command.
+func WithTTY(tty bool) Option {
+	return func(o *runOnOptions) {
+		o.tty = tty
+	}
+}
+
+// WithInsecureIgnoreHostKey accepts any host key, instead of verifying it
+// against ~/.ssh/known_hosts.
+func WithInsecureIgnoreHostKey() Option {
+	return func(o *runOnOptions) {
+		o.insecureIgnoreHostKey = true
+	}
+}
+
+// RunOn runs a single command on a single host and returns its output
+// and exit code. It's a shortcut for library users who don't need to build
+// a whole Supfile, Network and Command. A non-zero exit code is reported
+// in the Result, not as an error.
+func RunOn(host string, cmd string, opts ...Option) (*Result, error) {
+	var o runOnOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	env := o.env.AsExport() + `export SUP_HOST="` + host + `";`
+
+	var client Client
+	if host == "localhost" {
+		local := &LocalhostClient{
+			env: env,
+		}
+		if err := local.Connect(host); err != nil {
+			return nil, errors.Wrap(err, "connecting to localhost failed")
+		}
+		client = local
+	} else {
+		hostKeyCallback, err := NewHostKeyCallback(o.insecureIgnoreHostKey)
+		if err != nil {
+			return nil, err
+		}
+		remote := &SSHClient{
+			env:             env,
+			user:            o.user,
+			hostKeyCallback: hostKeyCallback,
+		}
+		if o.bastion != "" {
+			bastion := &SSHClient{
+				hostKeyCallback: hostKeyCallback,
+			}
+			if err := bastion.Connect(o.bastion); err != nil {
+				return nil, errors.Wrap(err, "connecting to bastion failed")
+			}
+			defer bastion.Close()
+			if err := remote.ConnectWith(host, bastion.DialThrough); err != nil {
+				return nil, errors.Wrap(err, "connecting to remote host through bastion failed")
+			}
+		} else {
+			if err := remote.Connect(host); err != nil {
+				return nil, errors.Wrap(err, "connecting to remote host failed")
+			}
+		}
+		defer remote.Close()
+		client = remote
+	}
+
+	start := time.Now()
+	task := &Task{
+		Run:     cmd,
+		Input:   o.input,
+		Clients: []Client{client},
+		TTY:     o.tty,
+	}
+	if err := client.Run(task); err != nil {
+		return nil, errors.Wrap(err, "task failed")
+	}
+
+	var stdout, stderr bytes.Buffer
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(&stdout, client.Stdout())
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(&stderr, client.Stderr())
+	}()
+
+	if task.Input != nil {
+		go func() {
+			io.Copy(client.Stdin(), task.Input)
+			client.WriteClose()
+		}()
+	} else {
+		client.WriteClose()
+	}
+
+	// Wait for the command concurrently with the I/O operations, so lingering
+	// child processes holding the output open don't block forever.
+	err := client.Wait()
+	end := time.Now()
+	wg.Wait()
+
+	res := &Result{
+		Host:     host,
+		Command:  cmd,
+		Resolved: clientCommand(client),
+		Start:    start,
+		End:      end,
+	}
+	res.Stdout = stdout.Bytes()
+	res.Stderr = stderr.Bytes()
+	if err != nil {
+		status, ok := exitStatus(err)
+		if !ok {
+			res.ExitCode = -1
+			return res, errors.Wrap(err, "waiting for command failed")
+		}
+		res.ExitCode = status
+	}
+
+	return res, nil
+}
+
+// exitCode returns the exit code of a command finished with the given error:
+// 0 on success and -1 if the command didn't exit normally.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if status, ok := exitStatus(err); ok {
+		return status
+	}
+	return -1
+}
+
+// exitStatusError is the error of a command that exited with a non-zero
+// status, ie. *ssh.ExitError or *FakeExitError.
+type exitStatusError interface {
+	error
+	ExitStatus() int
+}
+
+// exitStatus returns the exit status of a finished remote or local command.
+func exitStatus(err error) (int, bool) {
+	switch e := err.(type) {
+	case exitStatusError:
+		return e.ExitStatus(), true
+	case *exec.ExitError:
+		return e.ExitCode(), true
+	case ErrExpect:
+		return 1, true
+	}
+	return 0, false
+}
@@ -0,0 +1,191 @@
+package sup
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// parseCount parses a number of hosts given either as an absolute number,
+// ie. "2", or as a percentage of total, ie. "25%". Percentages are rounded
+// up, so they're always at least one host.
+func parseCount(value string, total int) (int, error) {
+	if strings.HasSuffix(value, "%") {
+		percent, err := strconv.Atoi(strings.TrimSuffix(value, "%"))
+		if err != nil || percent <= 0 || percent > 100 {
+			return 0, fmt.Errorf("invalid percentage %q", value)
+		}
+		return (total*percent + 99) / 100, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid number of hosts %q", value)
+	}
+	return n, nil
+}
+
+// rolloutSerial returns the number of hosts the command is rolled out to
+// at a time, as limited by its max_unavailable.
+func rolloutSerial(cmd *Command, hosts int) (int, error) {
+	if cmd.MaxUnavailable == "" {
+		return cmd.Serial, nil
+	}
+	n, err := parseCount(cmd.MaxUnavailable, hosts)
+	if err != nil {
+		return 0, errors.Wrap(err, "max_unavailable")
+	}
+	return n, nil
+}
+
+// clientGroup is a group of clients running a task at once.
+type clientGroup struct {
+	clients []Client
+	env     string // Exports of the batch's env vars.
+}
+
+// splitClients splits the clients to the command's batches, followed by
+// groups of serial clients, or all the remaining clients, if serial is
+// zero. Batches larger than forks are split further. With group_serial,
+// the remaining clients are split to rounds first, see groupRounds.
+func (sup *Stackup) splitClients(cmd *Command, network *Network, clients []Client, serial int) ([]clientGroup, error) {
+	var groups []clientGroup
+	total := len(clients)
+	for i, batch := range cmd.Batches {
+		n, err := parseCount(batch.Hosts, total)
+		if err != nil {
+			return nil, errors.Wrapf(err, "batches[%v]", i)
+		}
+		if n > len(clients) {
+			n = len(clients)
+		}
+		env := batch.Env.AsExport()
+		if sup.noEnv {
+			env = ""
+		}
+		size := n
+		if sup.forks > 0 && sup.forks < size {
+			size = sup.forks
+		}
+		for j := 0; j < n; j += size {
+			k := j + size
+			if k > n {
+				k = n
+			}
+			groups = append(groups, clientGroup{clients: clients[j:k], env: env})
+		}
+		clients = clients[n:]
+	}
+
+	rounds := [][]Client{clients}
+	if cmd.GroupSerial > 0 {
+		rounds = groupRounds(network.HostGroups, clients, cmd.GroupSerial)
+	}
+	for _, clients := range rounds {
+		size := serial
+		if size <= 0 {
+			size = len(clients)
+		}
+		for i := 0; i < len(clients); i += size {
+			j := i + size
+			if j > len(clients) {
+				j = len(clients)
+			}
+			groups = append(groups, clientGroup{clients: clients[i:j]})
+		}
+	}
+	return groups, nil
+}
+
+// groupRounds splits the clients to rounds run one after another, so
+// there's at most n clients of each host group in a round. The first round
+// runs n clients of each group and all the clients of no group, the second
+// one the next n clients of each group, and so on. The hosts are matched
+// without the user, see hostKey, as the clients of user: commands connect
+// as another user.
+func groupRounds(hostGroups map[string][]string, clients []Client, n int) [][]Client {
+	groupOf := map[string]string{}
+	for group, hosts := range hostGroups {
+		for _, host := range hosts {
+			groupOf[hostKey(host)] = group
+		}
+	}
+
+	var rounds [][]Client
+	seen := map[string]int{} // Clients of each group in the previous rounds.
+	for _, c := range clients {
+		round := 0
+		if group, ok := groupOf[hostKey(clientHost(c))]; ok {
+			round = seen[group] / n
+			seen[group]++
+		}
+		for len(rounds) <= round {
+			rounds = append(rounds, nil)
+		}
+		rounds[round] = append(rounds[round], c)
+	}
+	return rounds
+}
+
+// waitHealthy runs the healthcheck quietly on the task's clients until it
+// passes, or it runs out of retries, so the failed retries aren't reported
+// as the command's results. It fails, if less than the command's
+// min_healthy hosts pass the healthcheck.
+func (sup *Stackup) waitHealthy(cmd *Command, task *Task, batch, batches int) error {
+	hc := cmd.Healthcheck
+	minHealthy := len(task.Clients)
+	if cmd.MinHealthy != "" {
+		n, err := parseCount(cmd.MinHealthy, len(task.Clients))
+		if err != nil {
+			return errors.Wrap(err, "min_healthy")
+		}
+		minHealthy = n
+	}
+	interval := time.Duration(hc.Interval) * time.Second
+	if interval == 0 {
+		interval = time.Second
+	}
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		healthy int
+	)
+	for _, c := range task.Clients {
+		wg.Add(1)
+		go func(c Client) {
+			defer wg.Done()
+			check := &Task{
+				Run:     hc.Run,
+				Clients: []Client{c},
+				Shell:   task.Shell,
+				Login:   task.Login,
+			}
+			for i := 0; i <= hc.Retries; i++ {
+				if i > 0 {
+					time.Sleep(interval)
+				}
+				if _, err := runCapture(c, check); err == nil {
+					mu.Lock()
+					healthy++
+					mu.Unlock()
+					return
+				}
+			}
+		}(c)
+	}
+	wg.Wait()
+
+	sup.log(LogEntry{
+		Level:   LogInfo,
+		Message: fmt.Sprintf("%v: batch %v/%v: %v/%v host(s) healthy", cmd.Name, batch, batches, healthy, len(task.Clients)),
+		Command: cmd.Name,
+	})
+	if healthy < minHealthy {
+		return fmt.Errorf("%v: batch %v/%v: %v host(s) healthy, %v required", cmd.Name, batch, batches, healthy, minHealthy)
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package sup
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Shell connects to all hosts of the network once and runs commands read
+// from in, line by line, on all of them, until EOF (ie. Ctrl-D). A failed
+// command doesn't end the shell. The prompt is written to prompt, if set.
+func (sup *Stackup) Shell(network *Network, envVars EnvList, in io.Reader, prompt io.Writer) error {
+	env := envVars.AsExport()
+
+	defer sup.closeBastions()
+	clients, err := sup.connect(network, env, "")
+	if err != nil {
+		return err
+	}
+	defer closeClients(clients)
+
+	maxLen := prefixLen(clients)
+	raw := sup.raw || len(clients) == 1
+
+	// Interrupts are passed to the clients while a command is running.
+	// Don't let them kill the shell in between the commands.
+	trap := make(chan os.Signal, 1)
+	signal.Notify(trap, os.Interrupt)
+	defer func() {
+		signal.Stop(trap)
+		close(trap)
+	}()
+	go func() {
+		for range trap {
+		}
+	}()
+
+	scanner := bufio.NewScanner(in)
+	for {
+		if prompt != nil {
+			fmt.Fprint(prompt, "sup> ")
+		}
+		if !scanner.Scan() {
+			break
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		cmd := &Command{
+			Name: line,
+			Run:  line,
+		}
+		err := sup.runCommand(cmd, network, clients, env, maxLen, raw)
+		if _, ok := err.(ErrExitStatus); !ok && err != nil {
+			// Failed hosts were reported already.
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}
+	if prompt != nil {
+		fmt.Fprintln(prompt)
+	}
+
+	return errors.Wrap(scanner.Err(), "reading commands failed")
+}
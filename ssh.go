@@ -8,19 +8,30 @@ import (
 	"os"
 	"os/user"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/pkg/errors"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/terminal"
 )
 
 // Client is a wrapper over the SSH connection/sessions.
 type SSHClient struct {
+	mu           sync.Mutex // Guards the state of the session, ie. for Close and Signal during Wait.
 	conn         *ssh.Client
 	sess         *ssh.Session
+	exits        *exitConn       // Notifies the sessions of their command's exit.
+	exited       <-chan struct{} // Closed when the command of the session exits.
+	output       activity        // Last read of the session's output.
 	user         string
 	host         string
+	name         string // Host as given to Connect.
 	remoteStdin  io.WriteCloser
 	remoteStdout io.Reader
 	remoteStderr io.Reader
@@ -28,7 +39,16 @@ type SSHClient struct {
 	sessOpened   bool
 	running      bool
 	env          string //export FOO="bar"; export BAR="baz";
+	command      string // Command last started by Run.
 	color        string
+	config       ssh.Config // Ciphers, key exchanges and MACs.
+	identityFile string     // Private key to try before the default ones.
+	noAgent      bool       // Don't offer ssh-agent keys.
+	password     string     // Password to try after the keys, if set.
+	port         int        // Port of hosts without one. 22, if not set.
+	alias        string     // Host name shown in the prefix instead of the dialed one, ie. by dial_host.
+
+	hostKeyCallback ssh.HostKeyCallback // Verifies host keys against known_hosts, if nil.
 }
 
 type ErrConnect struct {
@@ -43,6 +63,7 @@ func (e ErrConnect) Error() string {
 
 // parseHost parses and normalizes <user>@<host:port> from a given string.
 func (c *SSHClient) parseHost(host string) error {
+	c.name = host
 	c.host = host
 
 	// Remove extra "ssh://" schema
@@ -71,24 +92,27 @@ func (c *SSHClient) parseHost(host string) error {
 
 	// Add default port, if not set
 	if strings.Index(c.host, ":") == -1 {
-		c.host += ":22"
+		port := 22
+		if c.port != 0 {
+			port = c.port
+		}
+		c.host += ":" + strconv.Itoa(port)
 	}
 
 	return nil
 }
 
 var initAuthMethodOnce sync.Once
-var authMethod ssh.AuthMethod
+var agentSigners, keySigners []ssh.Signer
+var lockedKeys []string // Passphrase-protected keys that couldn't be used.
 
 // initAuthMethod initiates SSH authentication method.
 func initAuthMethod() {
-	var signers []ssh.Signer
-
 	// If there's a running SSH Agent, try to use its Private keys.
 	sock, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK"))
 	if err == nil {
 		agent := agent.NewClient(sock)
-		signers, _ = agent.Signers()
+		agentSigners, _ = agent.Signers()
 	}
 
 	// Try to read user's SSH private keys form the standard paths.
@@ -97,18 +121,154 @@ func initAuthMethod() {
 		if strings.HasSuffix(file, ".pub") {
 			continue // Skip public keys.
 		}
-		data, err := ioutil.ReadFile(file)
+		signers, err := getSigners(file)
 		if err != nil {
+			if _, ok := errors.Cause(err).(*ssh.PassphraseMissingError); ok {
+				lockedKeys = append(lockedKeys, file)
+			}
 			continue
 		}
-		signer, err := ssh.ParsePrivateKey(data)
-		if err != nil {
-			continue
+		keySigners = append(keySigners, signers...)
+	}
+}
+
+var signersCache = struct {
+	sync.Mutex
+	entries map[string]signersCacheEntry
+}{entries: map[string]signersCacheEntry{}}
+
+type signersCacheEntry struct {
+	signers []ssh.Signer
+	err     error
+}
+
+// getSigners returns signers of the private key file. Each file is read
+// and parsed only once, since many hosts usually share the same key.
+func getSigners(file string) ([]ssh.Signer, error) {
+	path, err := filepath.Abs(file)
+	if err != nil {
+		return nil, err
+	}
+
+	signersCache.Lock()
+	defer signersCache.Unlock()
+
+	entry, ok := signersCache.entries[path]
+	if !ok {
+		entry.signers, entry.err = parseSigners(path)
+		signersCache.entries[path] = entry
+	}
+	return entry.signers, entry.err
+}
+
+// parseSigners reads the private key file and returns its signer. If there's
+// a matching "<file>-cert.pub" SSH certificate, ie. signed by SSH CA,
+// the certificate signer is returned first.
+func parseSigners(file string) ([]ssh.Signer, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(data)
+	if _, ok := err.(*ssh.PassphraseMissingError); ok {
+		// Try the passphrase stored in the keychain, if any.
+		if passphrase, ok := keychainPassphrase(file); ok {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(data, passphrase)
 		}
-		signers = append(signers, signer)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, file)
+	}
+
+	certData, err := ioutil.ReadFile(file + "-cert.pub")
+	if err != nil {
+		return []ssh.Signer{signer}, nil
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(certData)
+	if err != nil {
+		return nil, errors.Wrap(err, file+"-cert.pub")
+	}
+	cert, ok := pub.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%v: not an SSH certificate", file+"-cert.pub")
+	}
+	certSigner, err := ssh.NewCertSigner(cert, signer)
+	if err != nil {
+		return nil, errors.Wrap(err, file+"-cert.pub")
+	}
+	return []ssh.Signer{certSigner, signer}, nil
+}
 
+// Algorithms supported by golang.org/x/crypto/ssh, with friendly aliases
+// for the names with "@openssh.com" and "@libssh.org" suffixes.
+var (
+	supportedCiphers = map[string]string{
+		"aes128-ctr":                    "aes128-ctr",
+		"aes192-ctr":                    "aes192-ctr",
+		"aes256-ctr":                    "aes256-ctr",
+		"aes128-gcm":                    "aes128-gcm@openssh.com",
+		"aes128-gcm@openssh.com":        "aes128-gcm@openssh.com",
+		"chacha20-poly1305":             "chacha20-poly1305@openssh.com",
+		"chacha20-poly1305@openssh.com": "chacha20-poly1305@openssh.com",
+		"arcfour256":                    "arcfour256",
+		"arcfour128":                    "arcfour128",
+		"arcfour":                       "arcfour",
+		"aes128-cbc":                    "aes128-cbc",
+		"3des-cbc":                      "3des-cbc",
+	}
+	supportedKeyExchanges = map[string]string{
+		"curve25519-sha256":                    "curve25519-sha256@libssh.org",
+		"curve25519-sha256@libssh.org":         "curve25519-sha256@libssh.org",
+		"ecdh-sha2-nistp256":                   "ecdh-sha2-nistp256",
+		"ecdh-sha2-nistp384":                   "ecdh-sha2-nistp384",
+		"ecdh-sha2-nistp521":                   "ecdh-sha2-nistp521",
+		"diffie-hellman-group14-sha1":          "diffie-hellman-group14-sha1",
+		"diffie-hellman-group1-sha1":           "diffie-hellman-group1-sha1",
+		"diffie-hellman-group-exchange-sha1":   "diffie-hellman-group-exchange-sha1",
+		"diffie-hellman-group-exchange-sha256": "diffie-hellman-group-exchange-sha256",
+	}
+	supportedMACs = map[string]string{
+		"hmac-sha2-256-etm":             "hmac-sha2-256-etm@openssh.com",
+		"hmac-sha2-256-etm@openssh.com": "hmac-sha2-256-etm@openssh.com",
+		"hmac-sha2-256":                 "hmac-sha2-256",
+		"hmac-sha1":                     "hmac-sha1",
+		"hmac-sha1-96":                  "hmac-sha1-96",
+	}
+)
+
+// NewSSHConfig returns SSH config restricted to the given ciphers, key
+// exchange and MAC algorithms. Go defaults are used for empty lists.
+func NewSSHConfig(ciphers, keyExchanges, macs []string) (ssh.Config, error) {
+	var config ssh.Config
+	var err error
+	if config.Ciphers, err = sshAlgorithms("cipher", ciphers, supportedCiphers); err != nil {
+		return config, err
+	}
+	if config.KeyExchanges, err = sshAlgorithms("key exchange", keyExchanges, supportedKeyExchanges); err != nil {
+		return config, err
+	}
+	if config.MACs, err = sshAlgorithms("MAC", macs, supportedMACs); err != nil {
+		return config, err
+	}
+	return config, nil
+}
+
+// sshAlgorithms maps the names to the supported algorithm names.
+func sshAlgorithms(kind string, names []string, supported map[string]string) ([]string, error) {
+	var algorithms []string
+	for _, name := range names {
+		algorithm, ok := supported[strings.TrimSpace(name)]
+		if !ok {
+			var names []string
+			for name := range supported {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			return nil, fmt.Errorf("unsupported %v algorithm %q, supported: %v", kind, name, strings.Join(names, ", "))
+		}
+		algorithms = append(algorithms, algorithm)
 	}
-	authMethod = ssh.PublicKeys(signers...)
+	return algorithms, nil
 }
 
 // SSHDialFunc can dial an ssh server and return a client
@@ -135,51 +295,157 @@ func (c *SSHClient) ConnectWith(host string, dialer SSHDialFunc) error {
 		return err
 	}
 
+	var signers []ssh.Signer
+	if c.identityFile != "" {
+		signers, err = getSigners(c.identityFile)
+		if err != nil {
+			return ErrConnect{c.user, c.host, err.Error()}
+		}
+	}
+	if !c.noAgent {
+		signers = append(signers, agentSigners...)
+	}
+	signers = append(signers, keySigners...)
+
+	hostKeyCallback := c.hostKeyCallback
+	if hostKeyCallback == nil {
+		hostKeyCallback, err = NewHostKeyCallback(false)
+		if err != nil {
+			return ErrConnect{c.user, c.host, err.Error()}
+		}
+	}
+
+	auth := []ssh.AuthMethod{
+		ssh.PublicKeys(signers...),
+	}
+	if c.password != "" {
+		auth = append(auth, ssh.Password(c.password))
+	}
+	// Prompt for keyboard-interactive challenges (ie. 2FA), if there's
+	// a terminal to answer them.
+	if stdinIsTerminal() {
+		auth = append(auth, ssh.KeyboardInteractive(c.keyboardInteractive))
+	}
+
 	config := &ssh.ClientConfig{
-		User: c.user,
-		Auth: []ssh.AuthMethod{
-			authMethod,
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Config:          c.config,
+		User:            c.user,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
 	}
 
 	c.conn, err = dialer("tcp", c.host, config)
 	if err != nil {
-		return ErrConnect{c.user, c.host, err.Error()}
+		reason := err.Error()
+		if len(lockedKeys) > 0 && len(agentSigners) == 0 && strings.Contains(reason, "unable to authenticate") {
+			reason += fmt.Sprintf(" (passphrase-protected keys %v were skipped, add them to ssh-agent by ssh-add)", strings.Join(lockedKeys, ", "))
+		}
+		return ErrConnect{c.user, c.host, reason}
 	}
+	c.exits = &exitConn{Conn: c.conn.Conn}
 	c.connOpened = true
 
 	return nil
 }
 
+// promptMu serializes keyboard-interactive prompts of hosts connecting
+// in parallel.
+var promptMu sync.Mutex
+
+// stdinIsTerminal reports whether STDIN is a terminal to answer prompts on.
+var stdinIsTerminal = func() bool {
+	return terminal.IsTerminal(int(os.Stdin.Fd()))
+}
+
+// readAnswer reads the answer to a prompt from STDIN. Answers that shouldn't
+// be echoed are read with echo disabled.
+var readAnswer = func(echo bool) ([]byte, error) {
+	if echo {
+		return readLine(os.Stdin)
+	}
+	answer, err := terminal.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	return answer, err
+}
+
+// keyboardInteractive prompts the user for answers to the host's challenges
+// on the terminal. Answers to the questions that shouldn't be echoed,
+// ie. passwords or OTP codes, are read with echo disabled.
+func (c *SSHClient) keyboardInteractive(user, instruction string, questions []string, echos []bool) ([]string, error) {
+	promptMu.Lock()
+	defer promptMu.Unlock()
+
+	if instruction != "" {
+		fmt.Fprintf(os.Stderr, "%v@%v: %v\n", c.user, c.host, instruction)
+	}
+	answers := make([]string, len(questions))
+	for i, question := range questions {
+		fmt.Fprintf(os.Stderr, "%v@%v: %v", c.user, c.host, question)
+		answer, err := readAnswer(echos[i])
+		if err != nil {
+			return nil, errors.Wrap(err, "reading answer failed")
+		}
+		answers[i] = string(answer)
+	}
+	return answers, nil
+}
+
+// readLine reads a line from r byte by byte, so nothing past the line is
+// consumed.
+func readLine(r io.Reader) ([]byte, error) {
+	var line []byte
+	b := make([]byte, 1)
+	for {
+		n, err := r.Read(b)
+		if n == 1 {
+			if b[0] == '\n' {
+				return line, nil
+			}
+			line = append(line, b[0])
+		}
+		if err == io.EOF && len(line) > 0 {
+			return line, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
 // Run runs the task.Run command remotely on c.host.
 func (c *SSHClient) Run(task *Task) error {
 	if c.running {
 		return fmt.Errorf("Session already running")
 	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	if c.sessOpened {
 		return fmt.Errorf("Session already connected")
 	}
 
-	sess, err := c.conn.NewSession()
+	sess, exited, err := c.exits.newSession()
 	if err != nil {
 		return err
 	}
+	c.exited = exited
 
 	c.remoteStdin, err = sess.StdinPipe()
 	if err != nil {
 		return err
 	}
 
-	c.remoteStdout, err = sess.StdoutPipe()
+	stdout, err := sess.StdoutPipe()
 	if err != nil {
 		return err
 	}
+	c.remoteStdout = c.output.reader(stdout)
 
-	c.remoteStderr, err = sess.StderrPipe()
+	stderr, err := sess.StderrPipe()
 	if err != nil {
 		return err
 	}
+	c.remoteStderr = c.output.reader(stderr)
 
 	if task.TTY {
 		// Set up terminal modes
@@ -195,7 +461,9 @@ func (c *SSHClient) Run(task *Task) error {
 	}
 
 	// Start the remote command.
-	if err := sess.Start(c.env + task.Run); err != nil {
+	command := remoteCommand(c.env, task)
+	c.command = command
+	if err := sess.Start(command); err != nil {
 		return ErrTask{task, err.Error()}
 	}
 
@@ -205,21 +473,143 @@ func (c *SSHClient) Run(task *Task) error {
 	return nil
 }
 
+// remoteCommand returns the command to start on the remote host, with the
+// exported env vars and in the task's shell, if any.
+func remoteCommand(env string, task *Task) string {
+	command := env + task.Run
+	switch {
+	case task.Shell != "" && task.Login:
+		command = task.Shell + " -l -c " + shellQuote(command)
+	case task.Shell != "":
+		command = task.Shell + " -c " + shellQuote(command)
+	case task.Login:
+		command = "bash -l -c " + shellQuote(command)
+	}
+	return command
+}
+
 // Wait waits until the remote command finishes and exits.
 // It closes the SSH session.
 func (c *SSHClient) Wait() error {
+	c.mu.Lock()
 	if !c.running {
+		c.mu.Unlock()
 		return fmt.Errorf("Trying to wait on stopped session")
 	}
+	sess, exited := c.sess, c.exited
+	c.mu.Unlock()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- sess.Wait()
+	}()
+	var err error
+	select {
+	case err = <-done:
+	case <-exited:
+		err = waitOutput(sess, &c.output, done)
+	}
+	sess.Close()
 
-	err := c.sess.Wait()
-	c.sess.Close()
+	c.mu.Lock()
 	c.running = false
 	c.sessOpened = false
+	c.mu.Unlock()
 
 	return err
 }
 
+// waitOutput waits for the session to end after its command exited. The
+// session ends once the output streams are closed, which processes left
+// behind by the command, ie. daemons, may hold open. The session is closed
+// once there's no output for outputIdleTimeout, instead.
+func waitOutput(sess *ssh.Session, output *activity, done <-chan error) error {
+	output.touch()
+	ticker := time.NewTicker(outputIdleTimeout / 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-done:
+			return err
+		case <-ticker.C:
+			if output.idle() >= outputIdleTimeout {
+				sess.Close()
+				return <-done
+			}
+		}
+	}
+}
+
+// exitConn is an SSH connection notifying the sessions of their command's
+// exit as soon as the exit status arrives, before the session ends.
+type exitConn struct {
+	ssh.Conn
+	mu     sync.Mutex
+	exited chan struct{} // Of the session opened last.
+}
+
+// newSession opens a session on the connection. The returned channel is
+// closed when the session's command exits.
+func (c *exitConn) newSession() (*ssh.Session, <-chan struct{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sess, err := (&ssh.Client{Conn: c}).NewSession()
+	return sess, c.exited, err
+}
+
+func (c *exitConn) OpenChannel(name string, data []byte) (ssh.Channel, <-chan *ssh.Request, error) {
+	ch, reqs, err := c.Conn.OpenChannel(name, data)
+	if err != nil || name != "session" {
+		return ch, reqs, err
+	}
+
+	exited := make(chan struct{})
+	forwarded := make(chan *ssh.Request)
+	go func() {
+		defer close(forwarded)
+		var once sync.Once
+		for req := range reqs {
+			forwarded <- req
+			if req.Type == "exit-status" || req.Type == "exit-signal" {
+				once.Do(func() { close(exited) })
+			}
+		}
+	}()
+	c.exited = exited
+	return ch, forwarded, nil
+}
+
+// activity keeps the time of the last read of the readers.
+type activity struct {
+	last int64 // Unix nanoseconds.
+}
+
+func (a *activity) touch() {
+	atomic.StoreInt64(&a.last, time.Now().UnixNano())
+}
+
+// idle returns the time since the last read.
+func (a *activity) idle() time.Duration {
+	return time.Since(time.Unix(0, atomic.LoadInt64(&a.last)))
+}
+
+func (a *activity) reader(r io.Reader) io.Reader {
+	return &activityReader{r, a}
+}
+
+type activityReader struct {
+	r io.Reader
+	a *activity
+}
+
+func (r *activityReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.a.touch()
+	}
+	return n, err
+}
+
 // DialThrough will create a new connection from the ssh server sc is connected to. DialThrough is an SSHDialer.
 func (sc *SSHClient) DialThrough(net, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
 	conn, err := sc.conn.Dial(net, addr)
@@ -236,6 +626,9 @@ func (sc *SSHClient) DialThrough(net, addr string, config *ssh.ClientConfig) (*s
 
 // Close closes the underlying SSH connection and session.
 func (c *SSHClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	if c.sessOpened {
 		c.sess.Close()
 		c.sessOpened = false
@@ -251,6 +644,25 @@ func (c *SSHClient) Close() error {
 	return err
 }
 
+// Host returns the host as given to Connect.
+func (c *SSHClient) Host() string {
+	return c.name
+}
+
+// Command returns the final command string last started by Run, including
+// the exported environment variables and the shell wrappers.
+func (c *SSHClient) Command() string {
+	return c.command
+}
+
+// appendEnv exports the env vars of the export statements to the
+// subsequent commands, see Stackup.register.
+func (c *SSHClient) appendEnv(exports string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.env += exports
+}
+
 func (c *SSHClient) Stdin() io.WriteCloser {
 	return c.remoteStdin
 }
@@ -264,8 +676,8 @@ func (c *SSHClient) Stdout() io.Reader {
 }
 
 func (c *SSHClient) Prefix() (string, int) {
-	host := c.user + "@" + c.host + " | "
-	return c.color + host + ResetColor, len(host)
+	host := c.user + "@" + withAlias(c.host, c.alias) + " | "
+	return colorize(c.color, host), len(host)
 }
 
 func (c *SSHClient) Write(p []byte) (n int, err error) {
@@ -277,9 +689,13 @@ func (c *SSHClient) WriteClose() error {
 }
 
 func (c *SSHClient) Signal(sig os.Signal) error {
+	c.mu.Lock()
 	if !c.sessOpened {
+		c.mu.Unlock()
 		return fmt.Errorf("session is not open")
 	}
+	sess, stdin := c.sess, c.remoteStdin
+	c.mu.Unlock()
 
 	switch sig {
 	case os.Interrupt:
@@ -288,8 +704,8 @@ func (c *SSHClient) Signal(sig os.Signal) error {
 		// which sounds like something that should be fixed/resolved
 		// upstream in the golang.org/x/crypto/ssh pkg.
 		// https://github.com/golang/go/issues/4115#issuecomment-66070418
-		c.remoteStdin.Write([]byte("\x03"))
-		return c.sess.Signal(ssh.SIGINT)
+		stdin.Write([]byte("\x03"))
+		return sess.Signal(ssh.SIGINT)
 	default:
 		return fmt.Errorf("%v not supported", sig)
 	}
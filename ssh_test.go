@@ -0,0 +1,192 @@
+package sup
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSSHLingeringOutput(t *testing.T) {
+	// The server keeps the session open after the command exits, like sshd
+	// does while a background process holds the output.
+	release := make(chan struct{})
+	defer close(release)
+	s := newMockServer(t, nil, func(command string, ch ssh.Channel) {
+		ch.Write([]byte("started\n"))
+		mockExit(ch, 3)
+		<-release
+	})
+	mockHome(t, s)
+
+	sup, err := New(&Supfile{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := &SSHClient{}
+	if err := remote.Connect("test@" + s.addr); err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+
+	start := time.Now()
+	err = sup.runTask(&Task{Run: "sleep 5 & echo started; exit 3", Clients: []Client{remote}}, "lingering", 0, false)
+	if e, ok := err.(ErrExitStatus); !ok || e.Status != 3 {
+		t.Errorf("expected exit status 3, got %v", err)
+	}
+	if took := time.Since(start); took > 3*time.Second {
+		t.Errorf("task took %v, waited for the session to end", took)
+	}
+}
+
+func TestSSHKeyboardInteractive(t *testing.T) {
+	tests := []struct {
+		name     string
+		terminal bool
+		answers  []string
+		wantErr  bool
+	}{
+		{"answered", true, []string{"deploy", "123456"}, false},
+		{"wrong code", true, []string{"deploy", "000000"}, true},
+		{"no terminal", false, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &ssh.ServerConfig{
+				KeyboardInteractiveCallback: func(conn ssh.ConnMetadata, client ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+					answers, err := client(conn.User(), "Two-factor authentication", []string{"Name: ", "Code: "}, []bool{true, false})
+					if err != nil {
+						return nil, err
+					}
+					if len(answers) != 2 || answers[0] != "deploy" || answers[1] != "123456" {
+						return nil, errors.New("wrong answers")
+					}
+					return nil, nil
+				},
+			}
+			s := newMockServer(t, config, nil)
+			mockHome(t, s)
+
+			var echos []bool
+			answers := tt.answers
+			defer func(isTerminal func() bool, read func(bool) ([]byte, error)) {
+				stdinIsTerminal, readAnswer = isTerminal, read
+			}(stdinIsTerminal, readAnswer)
+			stdinIsTerminal = func() bool { return tt.terminal }
+			readAnswer = func(echo bool) ([]byte, error) {
+				echos = append(echos, echo)
+				if len(answers) == 0 {
+					return nil, io.EOF
+				}
+				answer := answers[0]
+				answers = answers[1:]
+				return []byte(answer), nil
+			}
+
+			remote := &SSHClient{}
+			err := remote.Connect("deploy@" + s.addr)
+			if err == nil {
+				remote.Close()
+			}
+			if tt.wantErr != (err != nil) {
+				t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+			}
+			if tt.terminal && (len(echos) != 2 || !echos[0] || echos[1]) {
+				t.Errorf("expected the name echoed and the code not, got echos %v", echos)
+			}
+			if !tt.terminal && len(echos) != 0 {
+				t.Errorf("expected no prompts without a terminal, got %v", len(echos))
+			}
+		})
+	}
+}
+
+// hangingServer starts a mock server, whose "hang" command prints a line
+// and never exits. The other commands succeed. The returned channel
+// receives each time the "hang" command starts.
+func hangingServer(t *testing.T) (*mockServer, <-chan struct{}) {
+	release := make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	hanging := make(chan struct{}, 1)
+	s := newMockServer(t, nil, func(command string, ch ssh.Channel) {
+		if strings.HasSuffix(command, "hang") {
+			ch.Write([]byte("partial\n"))
+			select {
+			case hanging <- struct{}{}:
+			default:
+			}
+			<-release
+			return
+		}
+		mockExit(ch, 0)
+	})
+	mockHome(t, s)
+	return s, hanging
+}
+
+func TestSSHDeadline(t *testing.T) {
+	s, _ := hangingServer(t)
+	defer func(grace time.Duration) { DeadlineGrace = grace }(DeadlineGrace)
+	DeadlineGrace = 100 * time.Millisecond
+
+	sup, err := New(&Supfile{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sup.Deadline(300 * time.Millisecond)
+	var results []Result
+	sup.OnResult(func(res Result) { results = append(results, res) })
+	network := &Network{Hosts: []string{"test@" + s.addr}}
+
+	err = sup.Run(network, nil, &Command{Name: "hang", Run: "hang"})
+	if _, ok := err.(ErrDeadline); !ok {
+		t.Fatalf("expected ErrDeadline, got %v", err)
+	}
+	if len(results) != 1 || !results[0].TimedOut || string(results[0].Stdout) != "partial\n" {
+		t.Fatalf("expected the timed out result with partial output, got %+v", results)
+	}
+
+	// The next run starts with a deadline of its own.
+	results = nil
+	if err := sup.Run(network, nil, &Command{Name: "ok", Run: "true"}); err != nil {
+		t.Fatalf("expected the next run to succeed, got %v", err)
+	}
+	if len(results) != 1 || results[0].TimedOut {
+		t.Errorf("expected the result of the next run, got %+v", results)
+	}
+}
+
+func TestSSHCancelHost(t *testing.T) {
+	s, hanging := hangingServer(t)
+	host := "test@" + s.addr
+
+	sup, err := New(&Supfile{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var results []Result
+	sup.OnResult(func(res Result) { results = append(results, res) })
+	network := &Network{Hosts: []string{host}}
+
+	// Cancel the host once it runs the command, not while it connects.
+	go func() {
+		<-hanging
+		sup.CancelHost(host)
+	}()
+	sup.Run(network, nil, &Command{Name: "hang", Run: "hang"})
+	if len(results) != 1 || !results[0].Cancelled {
+		t.Fatalf("expected the cancelled result, got %+v", results)
+	}
+
+	// The host isn't skipped by the next run.
+	results = nil
+	if err := sup.Run(network, nil, &Command{Name: "ok", Run: "true"}); err != nil {
+		t.Fatalf("expected the next run to succeed, got %v", err)
+	}
+	if len(results) != 1 || results[0].Cancelled {
+		t.Errorf("expected the result of the next run, got %+v", results)
+	}
+}
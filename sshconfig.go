@@ -0,0 +1,215 @@
+package sup
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// maxIncludeDepth limits nesting of Include directives, so include loops fail.
+const maxIncludeDepth = 16
+
+// SSHConfig is a parsed ssh_config file, including the files pulled in
+// by Include directives.
+type SSHConfig struct {
+	blocks []*sshConfigBlock
+}
+
+// sshConfigBlock is a Host or Match block of ssh_config.
+type sshConfigBlock struct {
+	patterns []string // Host patterns; empty for options applying to all hosts.
+	never    bool     // Match block with unsupported criteria.
+	options  [][2]string
+}
+
+// SSHHostConfig is the configuration of a single host found in ssh_config.
+type SSHHostConfig struct {
+	HostName     string
+	User         string
+	Port         int // 0, if not set.
+	IdentityFile string
+	ProxyCommand string
+}
+
+// ParseSSHConfig parses the ssh_config file. It supports Host blocks,
+// Match blocks with the "all", "host" and "originalhost" criteria, and
+// Include directives. Match blocks with other criteria never match.
+func ParseSSHConfig(path string) (*SSHConfig, error) {
+	conf := &SSHConfig{
+		blocks: []*sshConfigBlock{{}},
+	}
+	if err := conf.parseFile(path, 0); err != nil {
+		return nil, err
+	}
+	return conf, nil
+}
+
+func (conf *SSHConfig) parseFile(path string, depth int) error {
+	if depth > maxIncludeDepth {
+		return fmt.Errorf("%v: too many nested includes", path)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		// Both "Keyword value" and "Keyword=value" forms are valid.
+		i := strings.IndexAny(line, " \t=")
+		if i == -1 {
+			return fmt.Errorf("%v:%v: missing value of %v", path, lineNo, line)
+		}
+		keyword := strings.ToLower(line[:i])
+		value := strings.TrimSpace(line[i:])
+		value = strings.TrimSpace(strings.TrimPrefix(value, "="))
+		value = strings.Trim(value, `"`)
+
+		switch keyword {
+		case "host":
+			conf.blocks = append(conf.blocks, &sshConfigBlock{
+				patterns: strings.Fields(value),
+			})
+
+		case "match":
+			block, err := parseMatch(value)
+			if err != nil {
+				return fmt.Errorf("%v:%v: %v", path, lineNo, err)
+			}
+			conf.blocks = append(conf.blocks, block)
+
+		case "include":
+			for _, pattern := range strings.Fields(value) {
+				pattern = expandHome(pattern)
+				if !filepath.IsAbs(pattern) {
+					// Relative to ~/.ssh, as in the user's ssh_config.
+					pattern = filepath.Join(expandHome("~/.ssh"), pattern)
+				}
+				files, err := filepath.Glob(pattern)
+				if err != nil {
+					return fmt.Errorf("%v:%v: %v", path, lineNo, err)
+				}
+				for _, file := range files {
+					if err := conf.parseFile(file, depth+1); err != nil {
+						return err
+					}
+				}
+			}
+
+		default:
+			block := conf.blocks[len(conf.blocks)-1]
+			block.options = append(block.options, [2]string{keyword, value})
+		}
+	}
+	return errors.Wrap(scanner.Err(), path)
+}
+
+// parseMatch parses criteria of a Match block.
+func parseMatch(criteria string) (*sshConfigBlock, error) {
+	block := &sshConfigBlock{}
+	fields := strings.Fields(criteria)
+	for i := 0; i < len(fields); i++ {
+		switch strings.ToLower(fields[i]) {
+		case "all":
+		case "host", "originalhost":
+			if i+1 == len(fields) {
+				return nil, fmt.Errorf("missing argument of Match %v", fields[i])
+			}
+			i++
+			block.patterns = append(block.patterns, strings.Split(fields[i], ",")...)
+		default:
+			// Unsupported criteria, ie. "exec" or "user". Skip its argument.
+			block.never = true
+			i++
+		}
+	}
+	return block, nil
+}
+
+// matches reports whether the block applies to the host. Negated
+// patterns take precedence over the others.
+func (b *sshConfigBlock) matches(host string) bool {
+	if b.never {
+		return false
+	}
+	if len(b.patterns) == 0 {
+		return true
+	}
+	host = strings.ToLower(host)
+	matched := false
+	for _, pattern := range b.patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		pattern = strings.ToLower(strings.TrimPrefix(pattern, "!"))
+		if ok, _ := path.Match(pattern, host); ok {
+			if negated {
+				return false
+			}
+			matched = true
+		}
+	}
+	return matched
+}
+
+// Lookup returns the configuration of the host. As in ssh, the first
+// obtained value of each option is used.
+func (conf *SSHConfig) Lookup(host string) (SSHHostConfig, bool) {
+	var (
+		hostConf SSHHostConfig
+		found    bool
+		seen     = map[string]bool{}
+	)
+	for _, block := range conf.blocks {
+		if !block.matches(host) {
+			continue
+		}
+		for _, option := range block.options {
+			keyword, value := option[0], option[1]
+			if seen[keyword] {
+				continue
+			}
+			seen[keyword] = true
+
+			switch keyword {
+			case "hostname":
+				hostConf.HostName = value
+			case "user":
+				hostConf.User = value
+			case "port":
+				hostConf.Port, _ = strconv.Atoi(value)
+			case "identityfile":
+				hostConf.IdentityFile = expandHome(value)
+			case "proxycommand":
+				hostConf.ProxyCommand = value
+			default:
+				continue
+			}
+			found = true
+		}
+	}
+	return hostConf, found
+}
+
+// expandHome replaces the leading "~" of the path by the user's home directory.
+func expandHome(path string) string {
+	if path != "~" && !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[1:])
+}
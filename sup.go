@@ -1,12 +1,17 @@
 package sup
 
 import (
+	"bytes"
 	"fmt"
+	"hash/fnv"
 	"io"
+	"io/ioutil"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/goware/prefixer"
 	"github.com/pkg/errors"
@@ -19,11 +24,49 @@ type Stackup struct {
 	conf   *Supfile
 	debug  bool
 	prefix bool
+	raw    bool
+	colors []string
+	noTTY  bool
+	noEnv  bool
+	forks  int
+	logger Logger
+
+	connectForks int
+
+	mergeStderr bool
+	password    string
+	localTar    string
+	remoteTar   string
+
+	clientFactory ClientFactory
+	bastions      *bastionPool // Bastions of the connected clients.
+	bastionsMu    sync.Mutex
+	localState    string // Dir keeping the state of the persistent local session, if any.
+
+	onResult []func(Result)
+	resultMu sync.Mutex
+
+	onOutput []func(Output)
+	outputMu sync.Mutex
+
+	registered   map[string]string // Exports of registered env vars, by host.
+	registeredMu sync.Mutex
+
+	changed   map[string]map[string]bool // Hosts changed by the named uploads, by name.
+	changedMu sync.Mutex
+
+	deadline  time.Duration
+	running   map[Client]bool // Clients running a task.
+	cancelled map[string]bool // Cancelled hosts.
+	timedOut  map[Client]bool // Clients running a task, when the deadline was exceeded.
+	exceeded  *ErrDeadline
+	runningMu sync.Mutex
 }
 
 func New(conf *Supfile) (*Stackup, error) {
 	return &Stackup{
-		conf: conf,
+		conf:   conf,
+		colors: Colors,
 	}, nil
 }
 
@@ -35,211 +78,697 @@ func (sup *Stackup) Run(network *Network, envVars EnvList, commands ...*Command)
 		return errors.New("no commands to be run")
 	}
 
+	sup.resetRun()
+	if sup.deadline > 0 {
+		timer := time.AfterFunc(sup.deadline, sup.exceed)
+		defer timer.Stop()
+	}
+
 	env := envVars.AsExport()
 
-	// Create clients for every host (either SSH or Localhost).
-	var bastion *SSHClient
-	if network.Bastion != "" {
-		bastion = &SSHClient{}
-		if err := bastion.Connect(network.Bastion); err != nil {
-			return errors.Wrap(err, "connecting to bastion failed")
+	// Share the state of local commands for the whole run.
+	if network.PersistentLocal {
+		dir, err := ioutil.TempDir("", "sup-local")
+		if err != nil {
+			return errors.Wrap(err, "creating local session failed")
 		}
+		defer os.RemoveAll(dir)
+		sup.localState = dir
+		defer func() { sup.localState = "" }()
+	}
+
+	defer sup.closeBastions()
+	clients, err := sup.connect(network, env, "")
+	if err != nil {
+		return err
 	}
+	defer closeClients(clients)
+
+	maxLen := prefixLen(clients)
+
+	// Stream the output as is, if there's no other host to interleave with.
+	raw := sup.raw || len(clients) == 1
+
+	// Run command or run multiple commands defined by target sequentially.
+	for _, cmd := range commands {
+		if cmd.OnBastion {
+			err = sup.runCommandOnBastion(cmd, network, env, maxLen, raw)
+		} else if cmd.User != "" {
+			err = sup.runCommandAs(cmd.User, cmd, network, env, maxLen, raw)
+		} else {
+			err = sup.runCommand(cmd, network, clients, env, maxLen, raw)
+		}
+		if e := sup.deadlineExceeded(); e != nil {
+			return e
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// runCommandAs re-dials all hosts as the given SSH user and runs the command
+// on the new connections, which are closed once the command is done.
+func (sup *Stackup) runCommandAs(user string, cmd *Command, network *Network, env string, maxLen int, raw bool) error {
+	clients, err := sup.connect(network, env, user)
+	if err != nil {
+		return err
+	}
+	defer closeClients(clients)
+
+	if n := prefixLen(clients); n > maxLen {
+		maxLen = n
+	}
+	return sup.runCommand(cmd, network, clients, env, maxLen, raw)
+}
+
+// runCommandOnBastion runs the command on the network's bastion only.
+func (sup *Stackup) runCommandOnBastion(cmd *Command, network *Network, env string, maxLen int, raw bool) error {
+	bastion, err := sup.connectBastion(network, env)
+	if err != nil {
+		return errors.Wrap(err, cmd.Name)
+	}
+	defer bastion.Close()
+
+	clients := []Client{bastion}
+	if n := prefixLen(clients); n > maxLen {
+		maxLen = n
+	}
+	return sup.runCommand(cmd, network, clients, env, maxLen, raw)
+}
+
+// connect creates clients for every host of the network (either SSH
+// or Localhost), in the order of the hosts. The user, if set, overrides
+// the SSH user of all the remote hosts.
+func (sup *Stackup) connect(network *Network, env string, user string) ([]Client, error) {
+	connected, errs, err := sup.dial(network, env, user)
+	if err != nil {
+		return nil, err
+	}
+
+	var clients []Client
+	for _, client := range connected {
+		if client != nil {
+			clients = append(clients, client)
+		}
+	}
+	for _, err := range errs {
+		if err != nil {
+			closeClients(clients)
+			return nil, errors.Wrap(err, "connecting to clients failed")
+		}
+	}
+
+	return clients, nil
+}
+
+// dial connects to all the hosts of the network, returning the clients
+// and the connection errors in the order of hosts.
+func (sup *Stackup) dial(network *Network, env string, user string) ([]Client, []error, error) {
+	sshConfig, err := NewSSHConfig(network.Ciphers, network.KeyExchanges, network.MACs)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "configuring SSH algorithms failed")
+	}
+
+	// Set up host key verification, unless there's no remote host to verify.
+	var hostKeyCallback ssh.HostKeyCallback
+	hosts := append([]string{network.Bastion}, network.Hosts...)
+	for _, bastion := range network.HostBastion {
+		hosts = append(hosts, bastion)
+	}
+	for _, host := range hosts {
+		if host == "" || host == "localhost" {
+			continue
+		}
+		hostKeyCallback, err = NewHostKeyCallback(network.InsecureIgnoreHostKey)
+		if err != nil {
+			return nil, nil, err
+		}
+		break
+	}
+
+	// Bastions are connected to on demand, once for all their hosts, and
+	// closed by closeBastions.
+	bastions := sup.bastionPool(func() *SSHClient {
+		return &SSHClient{
+			config:          sshConfig,
+			identityFile:    network.BastionIdentityFile,
+			noAgent:         network.BastionNoAgent,
+			password:        sup.password,
+			hostKeyCallback: hostKeyCallback,
+		}
+	})
 
 	var wg sync.WaitGroup
-	clientCh := make(chan Client, len(network.Hosts))
-	errCh := make(chan error, len(network.Hosts))
+	connected := make([]Client, len(network.Hosts)) // In the order of hosts.
+	errs := make([]error, len(network.Hosts))
+
+	// Limit number of simultaneous SSH handshakes, if set.
+	var forks chan struct{}
+	if sup.connectForks > 0 {
+		forks = make(chan struct{}, sup.connectForks)
+	}
 
 	for i, host := range network.Hosts {
 		wg.Add(1)
 		go func(i int, host string) {
 			defer wg.Done()
 
+			if forks != nil {
+				forks <- struct{}{}
+				defer func() { <-forks }()
+			}
+
+			// Host's own env vars override the network's ones.
+			hostEnv := network.HostEnv[host]
+			env := env + hostEnv.AsExport() + sup.registeredEnv(host) + `export SUP_HOST="` + host + `";` +
+				`export SUP_HOST_INDEX="` + strconv.Itoa(i) + `";` +
+				`export SUP_HOST_COUNT="` + strconv.Itoa(len(network.Hosts)) + `";`
+			if sup.noEnv {
+				env = ""
+			}
+
+			// Client of the factory, if set.
+			if sup.clientFactory != nil {
+				c, err := sup.clientFactory(host, env)
+				if err != nil {
+					errs[i] = errors.Wrap(err, "creating client failed")
+					return
+				}
+				connected[i] = c
+				return
+			}
+
 			// Localhost client.
 			if host == "localhost" {
 				local := &LocalhostClient{
-					env: env + `export SUP_HOST="` + host + `";`,
+					env:   env,
+					state: sup.localState,
 				}
 				if err := local.Connect(host); err != nil {
-					errCh <- errors.Wrap(err, "connecting to localhost failed")
+					errs[i] = errors.Wrap(err, "connecting to localhost failed")
 					return
 				}
-				clientCh <- local
+				connected[i] = local
+				return
+			}
+
+			// Host name to dial, if transformed by dial_host. The client
+			// keeps the inventory's name.
+			name := host
+			host, alias, err := network.dialHost(host)
+			if err != nil {
+				errs[i] = errors.Wrap(err, "transforming host name failed")
+				return
+			}
+
+			// Client multiplexed over the host's ControlMaster.
+			if network.ControlPath != "" {
+				control := &ControlClient{
+					controlPath: network.ControlPath,
+					env:         env,
+					user:        network.User,
+					color:       sup.color(host),
+					defaultPort: network.Port,
+					alias:       alias,
+				}
+				if user != "" {
+					control.user = user
+					host, name = hostKey(host), hostKey(name)
+				}
+				if err := control.Connect(host); err != nil {
+					errs[i] = errors.Wrap(err, "connecting to remote host through ControlMaster failed")
+					return
+				}
+				control.name = name
+				connected[i] = control
 				return
 			}
 
 			// SSH client.
 			remote := &SSHClient{
-				env:   env + `export SUP_HOST="` + host + `";`,
-				user:  network.User,
-				color: Colors[i%len(Colors)],
+				env:             env,
+				user:            network.User,
+				color:           sup.color(host),
+				config:          sshConfig,
+				identityFile:    network.IdentityFile,
+				noAgent:         network.NoAgent,
+				password:        sup.password,
+				port:            network.Port,
+				alias:           alias,
+				hostKeyCallback: hostKeyCallback,
+			}
+
+			proxyCommand := network.proxyCommand(name)
+			bastionHost := network.bastion(name)
+			if user != "" {
+				remote.user = user
+				host, name = hostKey(host), hostKey(name)
 			}
 
-			if bastion != nil {
+			if proxyCommand != "" {
+				if err := remote.ConnectWith(host, ProxyCommandDialer(proxyCommand)); err != nil {
+					errs[i] = errors.Wrap(err, "connecting to remote host through ProxyCommand failed")
+					return
+				}
+			} else if bastionHost != "" {
+				bastion, err := bastions.get(bastionHost)
+				if err != nil {
+					errs[i] = err
+					return
+				}
 				if err := remote.ConnectWith(host, bastion.DialThrough); err != nil {
-					errCh <- errors.Wrap(err, "connecting to remote host through bastion failed")
+					errs[i] = errors.Wrap(err, "connecting to remote host through bastion failed")
 					return
 				}
 			} else {
 				if err := remote.Connect(host); err != nil {
-					errCh <- errors.Wrap(err, "connecting to remote host failed")
+					errs[i] = errors.Wrap(err, "connecting to remote host failed")
 					return
 				}
 			}
-			clientCh <- remote
+			remote.name = name
+			connected[i] = remote
 		}(i, host)
 	}
 	wg.Wait()
-	close(clientCh)
-	close(errCh)
 
-	maxLen := 0
-	var clients []Client
-	for client := range clientCh {
+	return connected, errs, nil
+}
+
+// closeClients closes connections of the SSH clients, but not of their
+// bastions, see closeBastions.
+func closeClients(clients []Client) {
+	for _, client := range clients {
 		if remote, ok := client.(*SSHClient); ok {
-			defer remote.Close()
+			remote.Close()
 		}
+	}
+}
+
+// prefixLen returns length of the longest host prefix of the clients.
+func prefixLen(clients []Client) int {
+	maxLen := 0
+	for _, client := range clients {
 		_, prefixLen := client.Prefix()
 		if prefixLen > maxLen {
 			maxLen = prefixLen
 		}
-		clients = append(clients, client)
 	}
-	for err := range errCh {
-		return errors.Wrap(err, "connecting to clients failed")
+	return maxLen
+}
+
+// runCommand translates the command into task(s) and runs them on the clients.
+func (sup *Stackup) runCommand(cmd *Command, network *Network, clients []Client, env string, maxLen int, raw bool) error {
+	clients = sup.activeClients(clients)
+	if cmd.RunIfChanged != "" {
+		clients = sup.changedClients(cmd, clients)
+	}
+	if len(clients) == 0 {
+		return nil
 	}
 
-	// Run command or run multiple commands defined by target sequentially.
-	for _, cmd := range commands {
-		// Translate command into task(s).
-		tasks, err := sup.createTasks(cmd, clients, env)
+	tasks, err := sup.createTasks(cmd, network, clients, env)
+	if err != nil {
+		return errors.Wrap(err, "creating task failed")
+	}
+
+	// Pipelines run on all the hosts at once, regardless of forks.
+	forked := sup.forks > 0 && sup.forks < len(clients)
+	if !forked && sup.pipelined(cmd, tasks) {
+		return sup.runPipeline(tasks, cmd.Name, maxLen, raw)
+	}
+
+	batches := 0
+	for _, task := range tasks {
+		if task.gated {
+			batches++
+		}
+	}
+
+	// Run tasks sequentially. Proceed to the next batch of hosts only
+	// when the previous batch is healthy.
+	batch := 0
+	for _, task := range tasks {
+		if task.drained {
+			if err := sup.drain(cmd, task); err != nil {
+				return err
+			}
+		}
+		if err := sup.runTask(task, cmd.Name, maxLen, raw); err != nil {
+			if task.step != "" {
+				sup.log(LogEntry{Level: LogError, Message: fmt.Sprintf("%v: %v failed", cmd.Name, task.step), Command: cmd.Name, Err: err})
+			}
+			return err
+		}
+		if task.gated {
+			batch++
+			if err := sup.waitHealthy(cmd, task, batch, batches); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// runTask runs the task on all its clients in parallel and waits for them
+// to finish. The output is prefixed by the host names, left-padded to maxLen,
+// unless it's raw.
+func (sup *Stackup) runTask(task *Task, name string, maxLen int, raw bool) error {
+	// Skip the cancelled hosts.
+	if clients := sup.activeClients(task.Clients); len(clients) != len(task.Clients) {
+		if len(clients) == 0 {
+			return nil
+		}
+		t := *task
+		t.Clients = clients
+		task = &t
+	}
+
+	var writers []io.Writer
+	var wg sync.WaitGroup
+	starts := make(map[Client]time.Time, len(task.Clients))
+	captured := make(map[Client]*bytes.Buffer) // STDOUT to register, or to check.
+	partial := make(map[Client][2]*tailBuffer) // Tail of STDOUT and STDERR, in case of timeout.
+	started := make([]Client, 0, len(task.Clients))
+	notFound := make(map[Client]error) // Clients missing the command, failed without running.
+
+	// Run tasks on the provided clients.
+	for _, c := range task.Clients {
+		var prefix string
+		var prefixLen int
+		if sup.prefix {
+			prefix, prefixLen = c.Prefix()
+			if len(prefix) < maxLen { // Left padding.
+				prefix = strings.Repeat(" ", maxLen-prefixLen) + prefix
+			}
+		}
+
+		if err := sup.startRunning(c); err != nil {
+			sup.finish(started, &wg)
+			return err
+		}
+		starts[c] = time.Now()
+		err := c.Run(task)
 		if err != nil {
-			return errors.Wrap(err, "creating task failed")
+			sup.stopRunning(c)
+			if _, ok := err.(ErrCommandNotFound); ok {
+				notFound[c] = err
+				continue
+			}
+			sup.finish(started, &wg)
+			return errors.Wrap(err, prefix+"task failed")
 		}
+		started = append(started, c)
+
+		stdout := c.Stdout()
+		if task.register != "" || task.expect != nil {
+			captured[c] = &bytes.Buffer{}
+			stdout = io.TeeReader(stdout, captured[c])
+		}
+		tails := [2]*tailBuffer{{size: partialOutputSize}, {size: partialOutputSize}}
+		partial[c] = tails
+		stdout = io.TeeReader(stdout, tails[0])
+		stderr := io.TeeReader(c.Stderr(), tails[1])
+		if len(sup.onOutput) > 0 {
+			stdout = io.TeeReader(stdout, &outputWriter{sup, Output{Host: clientHost(c), Command: name}})
+			stderr = io.TeeReader(stderr, &outputWriter{sup, Output{Host: clientHost(c), Command: name, Stderr: true}})
+		}
+
+		// Copy over tasks's STDOUT.
+		wg.Add(1)
+		go func(c Client) {
+			defer wg.Done()
+			_, err := io.Copy(os.Stdout, output(stdout, prefix, raw))
+			if err != nil && err != io.EOF {
+				// TODO: io.Copy() should not return io.EOF at all.
+				// Upstream bug? Or prefixer.WriteTo() bug?
+				sup.log(LogEntry{Level: LogError, Message: errors.Wrap(err, prefix+"reading STDOUT failed").Error(), Host: clientHost(c), Command: name, Err: err})
+			}
+		}(c)
+
+		// Copy over tasks's STDERR.
+		wg.Add(1)
+		go func(c Client) {
+			defer wg.Done()
+			_, err := io.Copy(os.Stderr, output(stderr, prefix, raw))
+			if err != nil && err != io.EOF {
+				sup.log(LogEntry{Level: LogError, Message: errors.Wrap(err, prefix+"reading STDERR failed").Error(), Host: clientHost(c), Command: name, Err: err})
+			}
+		}(c)
 
-		// Run tasks sequentially.
-		for _, task := range tasks {
-			var writers []io.Writer
-			var wg sync.WaitGroup
+		writers = append(writers, c.Stdin())
+	}
 
-			// Run tasks on the provided clients.
+	// The clients missing the command are reported as failed below;
+	// the others run the task as usual.
+	allClients := task.Clients
+	if len(started) != len(task.Clients) {
+		t := *task
+		t.Clients = started
+		task = &t
+	}
+
+	// Copy over task's STDIN.
+	if task.Input != nil {
+		go func() {
+			writer := io.MultiWriter(writers...)
+			_, err := io.Copy(writer, task.Input)
+			if err != nil && err != io.EOF {
+				sup.log(LogEntry{Level: LogError, Message: errors.Wrap(err, "copying STDIN failed").Error(), Command: name, Err: err})
+			}
+			// TODO: Use MultiWriteCloser (not in Stdlib), so we can writer.Close() instead?
 			for _, c := range task.Clients {
-				var prefix string
-				var prefixLen int
-				if sup.prefix {
-					prefix, prefixLen = c.Prefix()
-					if len(prefix) < maxLen { // Left padding.
-						prefix = strings.Repeat(" ", maxLen-prefixLen) + prefix
-					}
-				}
+				c.WriteClose()
+			}
+		}()
+	}
 
-				err := c.Run(task)
-				if err != nil {
-					return errors.Wrap(err, prefix+"task failed")
-				}
+	// Catch OS signals and pass them to all active clients. Stop catching
+	// the signals on return, so the goroutine ends on any return path.
+	trap := make(chan os.Signal, 1)
+	signal.Notify(trap, os.Interrupt)
+	defer func() {
+		signal.Stop(trap)
+		close(trap)
+	}()
+	go sup.catchSignals(trap, task.Clients)
+
+	// Make sure each client finishes the task, return on failure. Wait for
+	// the commands concurrently with the I/O operations, so the clients can
+	// close their output streams once the commands exit, even if some
+	// lingering child process still holds them open.
+	var (
+		failed     int // Exit status of the first failed client.
+		waitWg   sync.WaitGroup
+		waitErrs = make([]error, len(task.Clients))
+		ends     = make([]time.Time, len(task.Clients))
+	)
+	for i, c := range task.Clients {
+		waitWg.Add(1)
+		go func(i int, c Client) {
+			defer waitWg.Done()
+			waitErrs[i] = c.Wait()
+			sup.stopRunning(c)
+			ends[i] = time.Now()
+		}(i, c)
+	}
 
-				// Copy over tasks's STDOUT.
-				wg.Add(1)
-				go func(c Client) {
-					defer wg.Done()
-					_, err := io.Copy(os.Stdout, prefixer.New(c.Stdout(), prefix))
-					if err != nil && err != io.EOF {
-						// TODO: io.Copy() should not return io.EOF at all.
-						// Upstream bug? Or prefixer.WriteTo() bug?
-						fmt.Fprintf(os.Stderr, "%v", errors.Wrap(err, prefix+"reading STDOUT failed"))
-					}
-				}(c)
-
-				// Copy over tasks's STDERR.
-				wg.Add(1)
-				go func(c Client) {
-					defer wg.Done()
-					_, err := io.Copy(os.Stderr, prefixer.New(c.Stderr(), prefix))
-					if err != nil && err != io.EOF {
-						fmt.Fprintf(os.Stderr, "%v", errors.Wrap(err, prefix+"reading STDERR failed"))
-					}
-				}(c)
-
-				writers = append(writers, c.Stdin())
-			}
-
-			// Copy over task's STDIN.
-			if task.Input != nil {
-				go func() {
-					writer := io.MultiWriter(writers...)
-					_, err := io.Copy(writer, task.Input)
-					if err != nil && err != io.EOF {
-						fmt.Fprintf(os.Stderr, "%v", errors.Wrap(err, "copying STDIN failed"))
-					}
-					// TODO: Use MultiWriteCloser (not in Stdlib), so we can writer.Close() instead?
-					for _, c := range clients {
-						c.WriteClose()
-					}
-				}()
-			}
-
-			// Catch OS signals and pass them to all active clients.
-			trap := make(chan os.Signal, 1)
-			signal.Notify(trap, os.Interrupt)
-			go func() {
-				for {
-					select {
-					case sig, ok := <-trap:
-						if !ok {
-							return
-						}
-						for _, c := range task.Clients {
-							err := c.Signal(sig)
-							if err != nil {
-								fmt.Fprintf(os.Stderr, "%v", errors.Wrap(err, "sending signal failed"))
-							}
-						}
-					}
+	// Wait for all commands and I/O operations to finish.
+	waitWg.Wait()
+	wg.Wait()
+
+	for i, c := range task.Clients {
+		err := waitErrs[i]
+		var expectErr string
+		if err == nil && task.expect != nil {
+			err = task.expect.check(captured[c].Bytes())
+			if err != nil {
+				expectErr = err.Error()
+			}
+		}
+		cancelled := err != nil && sup.isCancelled(c)
+		timedOut := err != nil && sup.isTimedOut(c)
+		res := Result{
+			Host:      clientHost(c),
+			Command:   name,
+			Resolved:  clientCommand(c),
+			ExitCode:  exitCode(err),
+			Start:     starts[c],
+			End:       ends[i],
+			Ignored:   err != nil && task.IgnoreErrors,
+			Cancelled: cancelled,
+			TimedOut:  timedOut,
+			Error:     expectErr,
+		}
+		if timedOut {
+			res.Stdout, res.Stderr = partial[c][0].buf, partial[c][1].buf
+		}
+		sup.result(res)
+		if err == nil && task.register != "" {
+			sup.register(c, task.register, strings.TrimSpace(captured[c].String()))
+		}
+		if err != nil {
+			var prefix string
+			if sup.prefix {
+				var prefixLen int
+				prefix, prefixLen = c.Prefix()
+				if len(prefix) < maxLen { // Left padding.
+					prefix = strings.Repeat(" ", maxLen-prefixLen) + prefix
 				}
-			}()
+			}
+			entry := LogEntry{Level: LogError, Message: fmt.Sprintf("%s%v", prefix, err), Host: clientHost(c), Command: name, Err: err}
+			if cancelled {
+				entry.Level, entry.Message = LogWarn, entry.Message+" (cancelled)"
+				sup.log(entry)
+				continue
+			}
+			if timedOut {
+				entry.Message += " (timed out)"
+			}
+			if task.IgnoreErrors {
+				entry.Level, entry.Message = LogWarn, entry.Message+" (ignored)"
+				sup.log(entry)
+				continue
+			}
+			sup.log(entry)
 
-			// Wait for all I/O operations first.
-			wg.Wait()
+			status := 1
+			if s, ok := exitStatus(err); ok && s > 0 && s != 15 {
+				status = s
+			}
+			if failed == 0 {
+				failed = status
+			}
+		}
+	}
 
-			// Make sure each client finishes the task, return on failure.
-			for _, c := range task.Clients {
-				wg.Add(1)
-				go func(c Client) {
-					defer wg.Done()
-					if err := c.Wait(); err != nil {
-						var prefix string
-						if sup.prefix {
-							var prefixLen int
-							prefix, prefixLen = c.Prefix()
-							if len(prefix) < maxLen { // Left padding.
-								prefix = strings.Repeat(" ", maxLen-prefixLen) + prefix
-							}
-						}
-						if e, ok := err.(*ssh.ExitError); ok && e.ExitStatus() != 15 {
-							// TODO: Store all the errors, and print them after Wait().
-							fmt.Fprintf(os.Stderr, "%s%v\n", prefix, e)
-							os.Exit(e.ExitStatus())
-						}
-						fmt.Fprintf(os.Stderr, "%s%v\n", prefix, err)
-
-						// TODO: Shouldn't os.Exit(1) here. Instead, collect the exit statuses for later.
-						os.Exit(1)
-					}
-				}(c)
-			}
-
-			// Wait for all commands to finish.
-			wg.Wait()
-
-			// Stop catching signals for the currently active clients.
-			signal.Stop(trap)
-			close(trap)
+	for _, c := range allClients {
+		err, ok := notFound[c]
+		if !ok {
+			continue
+		}
+		sup.result(Result{
+			Host:     clientHost(c),
+			Command:  name,
+			Resolved: clientCommand(c),
+			ExitCode: 127,
+			Error:    err.Error(),
+			Start:    starts[c],
+			End:      starts[c],
+			Ignored:  task.IgnoreErrors,
+		})
+		if task.IgnoreErrors {
+			sup.log(LogEntry{Level: LogWarn, Message: err.Error() + " (ignored)", Host: clientHost(c), Command: name, Err: err})
+			continue
 		}
+		sup.log(LogEntry{Level: LogError, Message: err.Error(), Host: clientHost(c), Command: name, Err: err})
+		if failed == 0 {
+			failed = 127
+		}
+	}
+
+	if failed != 0 {
+		return ErrExitStatus{failed}
 	}
 
 	return nil
 }
 
+// output returns the reader of the client's output, prefixed line by line
+// unless it's raw.
+func output(r io.Reader, prefix string, raw bool) io.Reader {
+	if raw {
+		return r
+	}
+	// Read the prefixer by Read, as its WriteTo drops the last line,
+	// if it doesn't end with a newline, ie. the output of a killed command.
+	return &lineTerminator{r: prefixer.New(r, prefix)}
+}
+
+// lineTerminator ends the output with a newline, if it doesn't end
+// with one, so the last line doesn't run into the other hosts' output.
+type lineTerminator struct {
+	r    io.Reader
+	last byte
+	eof  bool
+}
+
+func (t *lineTerminator) Read(p []byte) (int, error) {
+	if t.eof {
+		if t.last != 0 && t.last != '\n' && len(p) > 0 {
+			p[0], t.last = '\n', '\n'
+			return 1, nil
+		}
+		return 0, io.EOF
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		t.last = p[n-1]
+	}
+	if err == io.EOF {
+		t.eof = true
+		err = nil
+	}
+	return n, err
+}
+
+// forceQuitWindow is how long after an interrupt another interrupt force
+// quits, instead of being passed to the clients again.
+const forceQuitWindow = 3 * time.Second
+
+// finish waits for the clients that started the task and for their output
+// to be copied, ie. when the task fails to start on another client, so their
+// goroutines end. Nothing more is written to their STDIN.
+func (sup *Stackup) finish(clients []Client, wg *sync.WaitGroup) {
+	for _, c := range clients {
+		c.WriteClose()
+		c.Wait()
+		sup.stopRunning(c)
+	}
+	wg.Wait()
+}
+
+// catchSignals passes signals received on trap to the clients, until trap
+// is closed. A second interrupt within forceQuitWindow closes the clients,
+// so the task fails even if the remote commands ignore the interrupt.
+func (sup *Stackup) catchSignals(trap chan os.Signal, clients []Client) {
+	var interrupted time.Time
+	for sig := range trap {
+		if sig == os.Interrupt && time.Since(interrupted) < forceQuitWindow {
+			sup.log(LogEntry{Level: LogWarn, Message: "Force quitting"})
+			for _, c := range clients {
+				c.Close()
+			}
+			continue
+		}
+
+		for _, c := range clients {
+			err := c.Signal(sig)
+			if err != nil {
+				sup.log(LogEntry{Level: LogError, Message: errors.Wrap(err, "sending signal failed").Error(), Host: clientHost(c), Err: err})
+			}
+		}
+		if sig == os.Interrupt {
+			interrupted = time.Now()
+			sup.log(LogEntry{Level: LogWarn, Message: "Interrupted, press Ctrl-C again to force quit"})
+		}
+	}
+}
+
+// ErrExitStatus is returned by Run, if a command fails on any host.
+// The error has been reported to STDERR already; Status is the exit
+// status of the first failed command.
+type ErrExitStatus struct {
+	Status int
+}
+
+func (e ErrExitStatus) Error() string {
+	return fmt.Sprintf("exit status %v", e.Status)
+}
+
 func (sup *Stackup) Debug(value bool) {
 	sup.debug = value
 }
@@ -247,3 +776,143 @@ func (sup *Stackup) Debug(value bool) {
 func (sup *Stackup) Prefix(value bool) {
 	sup.prefix = value
 }
+
+// OnResult registers a hook called with the result of each command
+// as soon as it finishes on a host. Hooks are not called concurrently.
+func (sup *Stackup) OnResult(fn func(Result)) {
+	sup.onResult = append(sup.onResult, fn)
+}
+
+// Output is a chunk of output of a command on a host, as passed to
+// the OnOutput hooks.
+type Output struct {
+	Host    string
+	Command string
+	Stderr  bool   // The chunk is of STDERR, instead of STDOUT.
+	Data    []byte // Raw output, without the host prefix.
+}
+
+// OnOutput registers a hook called with the output of the commands on
+// each host, as it's read. Hooks are not called concurrently and must not
+// keep the Data.
+func (sup *Stackup) OnOutput(fn func(Output)) {
+	sup.onOutput = append(sup.onOutput, fn)
+}
+
+// outputWriter passes the output written to it to the OnOutput hooks.
+type outputWriter struct {
+	sup    *Stackup
+	output Output
+}
+
+func (w *outputWriter) Write(p []byte) (int, error) {
+	w.sup.outputMu.Lock()
+	defer w.sup.outputMu.Unlock()
+	out := w.output
+	out.Data = p
+	for _, fn := range w.sup.onOutput {
+		fn(out)
+	}
+	return len(p), nil
+}
+
+// result passes the result to the registered hooks.
+func (sup *Stackup) result(res Result) {
+	sup.resultMu.Lock()
+	defer sup.resultMu.Unlock()
+	for _, fn := range sup.onResult {
+		fn(res)
+	}
+}
+
+// Forks limits number of hosts running a command simultaneously. The hosts
+// are split into batches of n hosts, run one after another, like with
+// the command's serial. Zero means no limit.
+func (sup *Stackup) Forks(n int) {
+	sup.forks = n
+}
+
+// ConnectForks limits number of hosts sup connects to simultaneously,
+// independently of Forks. Zero means no limit.
+func (sup *Stackup) ConnectForks(n int) {
+	sup.connectForks = n
+}
+
+// NoEnv runs the commands bare, without exporting any env vars, ie.
+// the Supfile's env, $SUP_HOST and the other default ones, or the
+// registered ones.
+func (sup *Stackup) NoEnv(value bool) {
+	sup.noEnv = value
+}
+
+// Raw streams the output byte-for-byte, without host prefixes or line
+// handling. Raw output is always used when running on a single host.
+func (sup *Stackup) Raw(value bool) {
+	sup.raw = value
+}
+
+// MergeStderr redirects STDERR of the commands to their STDOUT, so the order
+// of the output lines is kept.
+func (sup *Stackup) MergeStderr(value bool) {
+	sup.mergeStderr = value
+}
+
+// NoTTY disables pseudo terminals for all commands.
+func (sup *Stackup) NoTTY(value bool) {
+	sup.noTTY = value
+}
+
+// Tar sets the tar command of uploads run locally and on the hosts, ie.
+// "gtar" or "/opt/bin/tar". DefaultTar is used for the empty ones.
+func (sup *Stackup) Tar(local, remote string) {
+	sup.localTar = local
+	sup.remoteTar = remote
+}
+
+// tar returns the local and remote tar commands.
+func (sup *Stackup) tar() (local, remote string) {
+	local, remote = DefaultTar, DefaultTar
+	if strings.TrimSpace(sup.localTar) != "" {
+		local = sup.localTar
+	}
+	if strings.TrimSpace(sup.remoteTar) != "" {
+		remote = sup.remoteTar
+	}
+	return local, remote
+}
+
+// ClientFactory replaces the SSH and localhost clients of the hosts by
+// the clients of the factory, ie. FakeClients in tests.
+func (sup *Stackup) ClientFactory(factory ClientFactory) {
+	sup.clientFactory = factory
+}
+
+// Deadline limits the total duration of Run. Once it's exceeded, the
+// running commands are interrupted, closed after DeadlineGrace, and Run
+// returns ErrDeadline. Their results are reported as TimedOut, along with
+// the tail of their output.
+func (sup *Stackup) Deadline(value time.Duration) {
+	sup.deadline = value
+}
+
+// Password sets the SSH password used for all the hosts and the bastion,
+// if they don't accept any of the keys.
+func (sup *Stackup) Password(value string) {
+	sup.password = value
+}
+
+// Colors sets the palette used to colorize host prefixes.
+func (sup *Stackup) Colors(palette []string) {
+	sup.colors = palette
+}
+
+// color picks a color for the host from the palette. The color is derived
+// from a hash of the host name, so the host keeps its color across runs.
+func (sup *Stackup) color(host string) string {
+	if len(sup.colors) == 0 {
+		return ""
+	}
+	h := fnv.New32a()
+	h.Write([]byte(host))
+	return sup.colors[h.Sum32()%uint32(len(sup.colors))]
+}
@@ -0,0 +1,155 @@
+package sup
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// BenchmarkConnect connects to 100 mock servers at once, and a number of
+// them at a time, see Stackup.ConnectForks.
+func BenchmarkConnect(b *testing.B) {
+	network := &Network{}
+	var servers []*mockServer
+	for i := 0; i < 100; i++ {
+		s := newMockServer(b, nil, nil)
+		servers = append(servers, s)
+		network.Hosts = append(network.Hosts, "test@"+s.addr)
+	}
+	mockHome(b, servers...)
+
+	for _, forks := range []int{0, 10, 50} {
+		b.Run(fmt.Sprintf("connect-forks=%v", forks), func(b *testing.B) {
+			sup, err := New(&Supfile{})
+			if err != nil {
+				b.Fatal(err)
+			}
+			sup.ConnectForks(forks)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				clients, err := sup.connect(network, "", "")
+				if err != nil {
+					b.Fatal(err)
+				}
+				closeClients(clients)
+			}
+		})
+	}
+}
+
+// pipeClient is a FakeClient whose STDOUT stays open until the command is
+// waited for, like the output of a remote command.
+type pipeClient struct {
+	*FakeClient
+	runErr error // Returned by Run, if set.
+	stdout *io.PipeReader
+	w      *io.PipeWriter
+}
+
+func (c *pipeClient) Run(task *Task) error {
+	if c.runErr != nil {
+		return c.runErr
+	}
+	c.stdout, c.w = io.Pipe()
+	return c.FakeClient.Run(task)
+}
+
+func (c *pipeClient) Stdout() io.Reader {
+	return c.stdout
+}
+
+func (c *pipeClient) Wait() error {
+	c.w.Close()
+	return c.FakeClient.Wait()
+}
+
+func TestRunTaskGoroutines(t *testing.T) {
+	sup, err := New(&Supfile{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The first task starts the signal watcher of os/signal, which keeps
+	// running.
+	warmUp := NewFakeClient("warm-up", "", nil)
+	if err := sup.runTask(&Task{Run: "true", Clients: []Client{warmUp}}, "warm-up", 0, false); err != nil {
+		t.Fatal(err)
+	}
+
+	before := runtime.NumGoroutine()
+	for i := 0; i < 100; i++ {
+		ok := &pipeClient{FakeClient: NewFakeClient("ok", "", nil)}
+		if err := sup.runTask(&Task{Run: "true", Clients: []Client{ok}, Input: strings.NewReader("input")}, "ok", 0, false); err != nil {
+			t.Fatal(err)
+		}
+
+		// The task fails to start on the second client, after it started
+		// on the first one.
+		started := &pipeClient{FakeClient: NewFakeClient("started", "", nil)}
+		failed := &pipeClient{FakeClient: NewFakeClient("failed", "", nil), runErr: errors.New("connection lost")}
+		if err := sup.runTask(&Task{Run: "true", Clients: []Client{started, failed}}, "failed", 0, false); err == nil {
+			t.Fatal("expected the task to fail")
+		}
+	}
+
+	// The goroutines of the last task may take a moment to end.
+	var after int
+	for wait := 0; wait < 50; wait++ {
+		if after = runtime.NumGoroutine(); after <= before {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after > before {
+		t.Errorf("%v goroutines before running 200 tasks, %v after", before, after)
+	}
+}
+
+func TestGroupRounds(t *testing.T) {
+	hostGroups := map[string][]string{
+		"a": {"deploy@a1", "a2"},
+		"b": {"b1"},
+	}
+	// The clients of user: commands connect as another user.
+	var clients []Client
+	for _, host := range []string{"root@a1", "root@a2", "root@b1", "root@c1"} {
+		c := &FakeClient{}
+		c.Connect(host)
+		clients = append(clients, c)
+	}
+
+	var got []string
+	for _, round := range groupRounds(hostGroups, clients, 1) {
+		var hosts []string
+		for _, c := range round {
+			hosts = append(hosts, clientHost(c))
+		}
+		got = append(got, strings.Join(hosts, ","))
+	}
+	want := []string{"root@a1,root@b1,root@c1", "root@a2"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("rounds %q, want %q", got, want)
+	}
+}
+
+func TestClientHost(t *testing.T) {
+	c := &FakeClient{}
+	c.Connect("deploy@api1")
+	if host := clientHost(c); host != "deploy@api1" {
+		t.Errorf("clientHost() = %q, want the reported host", host)
+	}
+
+	// Clients not implementing HostClient are referred to by their prefix.
+	var plain struct{ Client }
+	plain.Client = c
+	if host := clientHost(plain); host != "deploy@api1" {
+		t.Errorf("clientHost() = %q, want the prefix", host)
+	}
+	if command := clientCommand(plain); command != "" {
+		t.Errorf("clientCommand() = %q, want none", command)
+	}
+}
@@ -2,10 +2,14 @@ package sup
 
 import (
 	"bytes"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/pkg/errors"
@@ -20,18 +24,77 @@ type Supfile struct {
 	Targets  Targets  `yaml:"targets"`
 	Env      EnvList  `yaml:"env"`
 	Version  string   `yaml:"version"`
+
+	// Network and command (or target) to run, if not given on the command line.
+	DefaultNetwork string `yaml:"default_network"`
+	DefaultCommand string `yaml:"default_command"`
+
+	// Facts gathered by --facts, instead of DefaultFacts.
+	Facts []Fact `yaml:"facts"`
+
+	// Minimum version of sup the Supfile requires, ie. "0.5".
+	MinVersion string `yaml:"min_version"`
 }
 
 // Network is group of hosts with extra custom env vars.
 type Network struct {
-	Env       EnvList  `yaml:"env"`
-	Inventory string   `yaml:"inventory"`
-	Hosts     []string `yaml:"hosts"`
-	Bastion   string   `yaml:"bastion"` // Jump host for the environment
+	Desc           string   `yaml:"desc"` // Network description.
+	Env            EnvList  `yaml:"env"`
+	EnvFile        []string `yaml:"env_file"` // .env files, overridden by env. Prefix by "-" to ignore missing file.
+	Inventory      string   `yaml:"inventory"`
+	InventoryFile  string   `yaml:"inventory_file"`  // Ansible-style INI inventory file
+	InventoryGroup string   `yaml:"inventory_group"` // Group of hosts in the inventory file
+	Hosts          []string `yaml:"hosts"`
+	Bastion        string   `yaml:"bastion"` // Jump host for the environment
+	Login          bool     `yaml:"login"`   // Run all commands in a login shell
+	Shell          string   `yaml:"shell"`   // Remote shell to run all commands with, ie. "/bin/ash"
+
+	// Run the commands on localhost, and the local commands, as if in one shell session,
+	// so they share the working directory and the exported env vars.
+	PersistentLocal bool `yaml:"persistent_local"`
+
+	// Env vars of single hosts, keyed by host. Override the network's env.
+	HostEnv map[string]EnvList `yaml:"host_env"`
+
+	// Jump hosts of single hosts, keyed by host. Override the network's bastion.
+	HostBastion map[string]string `yaml:"host_bastion"`
+
+	// Named groups of hosts, ie. by rack or availability zone, limited by command's group_serial.
+	HostGroups map[string][]string `yaml:"host_groups"`
+
+	// Local command to connect through, ie. "ssh -W %h:%p bastion". Overrides bastion.
+	ProxyCommand     string            `yaml:"proxy_command"`
+	HostProxyCommand map[string]string `yaml:"-"` // ProxyCommand of single hosts, ie. from ssh_config.
+
+	// ControlPath of running OpenSSH ControlMasters, ie. "~/.ssh/cm-%r@%h:%p", to run the commands
+	// through with the system ssh, instead of dialing the hosts. Overrides bastion and proxy_command.
+	ControlPath string `yaml:"control_path"`
+
+	// Host name to connect to instead of the inventory's one, ie. "%h.eu-west.internal", or the local
+	// command printing it, ie. "dig +short %h". The prefix of the output keeps the inventory's name.
+	DialHost        string `yaml:"dial_host"`
+	DialHostCommand string `yaml:"dial_host_command"`
+
+	// SSH algorithms. Go defaults, if empty.
+	Ciphers      []string `yaml:"ciphers"`
+	KeyExchanges []string `yaml:"kex"`
+	MACs         []string `yaml:"macs"`
 
 	// Should these live on Hosts too? We'd have to change []string to struct, even in Supfile.
 	User         string // `yaml:"user"`
-	IdentityFile string // `yaml:"identity_file"`
+	IdentityFile string `yaml:"identity_file"`
+	Port         int    `yaml:"port"` // SSH port of hosts without one. Defaults to 22.
+
+	// Accept any host key, instead of verifying it against ~/.ssh/known_hosts.
+	InsecureIgnoreHostKey bool `yaml:"insecure_ignore_host_key"`
+
+	// Prompt for the SSH password once and use it for all the hosts.
+	AskPass bool `yaml:"ask_pass"`
+
+	// Authentication per hop, so the bastion and the hosts can use different keys.
+	NoAgent             bool   `yaml:"no_agent"`              // Don't offer ssh-agent keys to the hosts
+	BastionIdentityFile string `yaml:"bastion_identity_file"` // Private key for the bastion
+	BastionNoAgent      bool   `yaml:"bastion_no_agent"`      // Don't offer ssh-agent keys to the bastion
 }
 
 // Networks is a list of user-defined networks
@@ -72,15 +135,82 @@ type Command struct {
 	Local  string   `yaml:"local"`  // Command(s) to be run locally.
 	Run    string   `yaml:"run"`    // Command(s) to be run remotelly.
 	Script string   `yaml:"script"` // Load command(s) from script and run it remotelly.
+	Steps  []string `yaml:"steps"`  // Commands to be run remotely one by one, stopping at the first failure.
 	Upload []Upload `yaml:"upload"` // See Upload struct.
 	Stdin  bool     `yaml:"stdin"`  // Attach localhost STDOUT to remote commands' STDIN?
 	Once   bool     `yaml:"once"`   // The command should be run "once" (on one host only).
 	Serial int      `yaml:"serial"` // Max number of clients processing a task in parallel.
+	TTY    *bool    `yaml:"tty"`    // Request a pseudo terminal? Defaults to true, except for uploads.
+	Login  bool     `yaml:"login"`  // Run the command(s) in a login shell, sourcing user's profile.
+	Shell  string   `yaml:"shell"`  // Shell to run the command(s) with. Overrides network's shell.
+	User   string   `yaml:"user"`   // SSH user to re-dial the hosts as, just for this command.
+	Debug  *bool    `yaml:"debug"`  // Trace the command(s) by "set -x" in debug mode? Defaults to true.
+
+	OnBastion bool `yaml:"on_bastion"` // Run on the network's bastion, instead of its hosts.
+
+	StdinFile string `yaml:"stdin_file"` // Feed the file to the commands' STDIN, instead of localhost STDIN.
+
+	IgnoreErrors bool   `yaml:"ignore_errors"` // Don't abort the run, if the command fails.
+	Register     string `yaml:"register"`      // Env var to capture STDOUT into, per host, for subsequent commands.
+
+	// Output assertions, ie. for smoke tests. Hosts whose STDOUT doesn't meet them fail, even on zero exit status.
+	Expect      string `yaml:"expect"`       // Regexp the STDOUT must match.
+	ExpectNot   string `yaml:"expect_not"`   // Regexp the STDOUT must not match.
+	ExpectEmpty bool   `yaml:"expect_empty"` // STDOUT must be empty, except for whitespace.
+
+	// Health-gated rollout. Hosts are number (ie. "2") or percentage (ie. "25%") of hosts.
+	MaxUnavailable string       `yaml:"max_unavailable"` // Max hosts to run the command on at a time. Overrides serial.
+	MinHealthy     string       `yaml:"min_healthy"`     // Min hosts of a batch to pass the healthcheck. All, if empty.
+	Healthcheck    *Healthcheck `yaml:"healthcheck"`     // Check to pass before the next batch of hosts.
+
+	// Taking a batch of hosts out of service, ie. out of a load balancer, before running the command on it.
+	Drain *Drain `yaml:"drain"`
+
+	// Leading batches of hosts with their own env vars, ie. a canary, run before the rest of hosts.
+	Batches []Batch `yaml:"batches"`
+
+	// Max number of hosts of each of the network's host_groups processing a task in parallel.
+	GroupSerial int `yaml:"group_serial"`
+
+	// Name of a preceding upload. Hosts the upload didn't change any file on skip the command.
+	RunIfChanged string `yaml:"run_if_changed"`
+
+	Networks []string `yaml:"networks"` // Networks the command is restricted to. All networks, if empty.
+	Tags     []string `yaml:"tags"`     // Tags to select the command by, see --tags and --skip-tags.
 
 	// API backward compatibility. Will be deprecated in v1.0.
 	RunOnce bool `yaml:"run_once"` // The command should be run once only.
 }
 
+// Batch is a leading batch of hosts of a rollout, ie. a canary.
+type Batch struct {
+	Hosts string  `yaml:"hosts"` // Number (ie. "1") or percentage (ie. "10%") of hosts.
+	Env   EnvList `yaml:"env"`   // Env vars of the batch. Override all other env vars.
+}
+
+// HasTag reports whether the command is tagged by the tag.
+func (c Command) HasTag(tag string) bool {
+	for _, t := range c.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// AvailableOn reports whether the command can be run on the given network.
+func (c Command) AvailableOn(network string) bool {
+	if len(c.Networks) == 0 {
+		return true
+	}
+	for _, name := range c.Networks {
+		if name == network {
+			return true
+		}
+	}
+	return false
+}
+
 // Commands is a list of user-defined commands
 type Commands struct {
 	Names []string
@@ -112,6 +242,18 @@ func (c *Commands) Get(name string) (Command, bool) {
 	return cmd, ok
 }
 
+// ResolvePaths joins the relative stdin_file paths of the commands with
+// the dir, ie. of the Supfile defining them, so they don't depend on the
+// directory sup runs from.
+func (conf *Supfile) ResolvePaths(dir string) {
+	for name, cmd := range conf.Commands.cmds {
+		if cmd.StdinFile != "" && !filepath.IsAbs(cmd.StdinFile) {
+			cmd.StdinFile = filepath.Join(dir, cmd.StdinFile)
+			conf.Commands.cmds[name] = cmd
+		}
+	}
+}
+
 // Targets is a list of user-defined targets
 type Targets struct {
 	Names   []string
@@ -146,23 +288,88 @@ func (t *Targets) Get(name string) ([]string, bool) {
 // Upload represents file copy operation from localhost Src path to Dst
 // path of every host in a given Network.
 type Upload struct {
-	Src string `yaml:"src"`
-	Dst string `yaml:"dst"`
-	Exc string `yaml:"exclude"`
+	Src string   `yaml:"src"`
+	Dst string   `yaml:"dst"`
+	Exc Patterns `yaml:"exclude"`
+
+	UseGitignore bool   `yaml:"use_gitignore"` // Exclude files ignored by .gitignore and .supignore of src.
+	Compress     string `yaml:"compress"`      // Compression of the tar stream, gzip (default), zstd or none.
+	Mkdir        bool   `yaml:"mkdir"`         // Create dst on the hosts, if it doesn't exist.
+	Name         string `yaml:"name"`          // Name to refer to the upload by run_if_changed.
+}
+
+// Patterns is a list of tar --exclude patterns. It maps to a YAML list,
+// or a comma-separated string for backward compatibility.
+type Patterns []string
+
+func (p *Patterns) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var list []string
+	if err := unmarshal(&list); err == nil {
+		*p = list
+		return nil
+	}
+
+	var csv string
+	if err := unmarshal(&csv); err != nil {
+		return err
+	}
+	*p = nil
+	for _, pattern := range strings.Split(csv, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			*p = append(*p, pattern)
+		}
+	}
+	return nil
+}
+
+// Healthcheck is a command run on a batch of hosts after a serial rollout
+// step, until it succeeds or runs out of retries.
+type Healthcheck struct {
+	Run      string `yaml:"run"`
+	Retries  int    `yaml:"retries"`  // Number of retries after the first failure.
+	Interval int    `yaml:"interval"` // Seconds between the retries. Defaults to 1.
+}
+
+// Drain is run on a batch of hosts before the command, until the number of
+// active connections printed by the poll command drops to the threshold.
+type Drain struct {
+	Run       string `yaml:"run"`       // Command taking the host out of service.
+	Poll      string `yaml:"poll"`      // Command printing the number of active connections.
+	Threshold int    `yaml:"threshold"` // Max active connections to proceed with.
+	Interval  int    `yaml:"interval"`  // Seconds between the polls. Defaults to 1.
+	Timeout   int    `yaml:"timeout"`   // Seconds to poll for at most, then proceed anyway. Defaults to 300.
 }
 
 // EnvVar represents an environment variable
 type EnvVar struct {
 	Key   string
 	Value string
+
+	// Literal value is exported as is, instead of being expanded by the
+	// remote shell. Set by SetLiteral.
+	Literal bool
+
+	// Resolved value is resolved locally by ResolveValues. Its quotes and
+	// backticks are escaped, but $VARs are still expanded by the remote
+	// shell, ie. of the resolved "\$HOME".
+	Resolved bool
 }
 
 func (e EnvVar) String() string {
 	return e.Key + `=` + e.Value
 }
 
-// AsExport returns the environment variable as a bash export statement
+// AsExport returns the environment variable as a bash export statement.
+// The value is double-quoted, so the remote shell expands $VARs and $(...)
+// in it, unless it's literal, which is single-quoted. Quotes, backslashes
+// and backticks of resolved values are escaped.
 func (e EnvVar) AsExport() string {
+	switch {
+	case e.Literal:
+		return `export ` + e.Key + `=` + shellQuote(e.Value) + `;`
+	case e.Resolved:
+		return `export ` + e.Key + `=` + doubleQuote(e.Value) + `;`
+	}
 	return `export ` + e.Key + `="` + e.Value + `";`
 }
 
@@ -178,6 +385,27 @@ func (e EnvList) Slice() []string {
 	return envs
 }
 
+// Copy returns a copy of the list, whose vars can be set without changing
+// the vars of the list.
+func (e EnvList) Copy() EnvList {
+	c := make(EnvList, len(e))
+	for i, v := range e {
+		v := *v
+		c[i] = &v
+	}
+	return c
+}
+
+// Get returns value of the given key, or an empty string if it's not set.
+func (e EnvList) Get(key string) string {
+	for _, v := range e {
+		if v.Key == key {
+			return v.Value
+		}
+	}
+	return ""
+}
+
 func (e *EnvList) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	items := []yaml.MapItem{}
 
@@ -195,35 +423,72 @@ func (e *EnvList) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	return nil
 }
 
-// Set key to be equal value in this list.
+// Set key to be equal value in this list. A key that's already set keeps
+// its position, so the order of the list is the order of first definition.
 func (e *EnvList) Set(key, value string) {
+	e.set(key, value, false)
+}
+
+// SetLiteral sets the key to the literal value, exported as is.
+func (e *EnvList) SetLiteral(key, value string) {
+	e.set(key, value, true)
+}
+
+func (e *EnvList) set(key, value string, literal bool) {
 	for i, v := range *e {
 		if v.Key == key {
 			(*e)[i].Value = value
+			(*e)[i].Literal = literal
+			(*e)[i].Resolved = false
 			return
 		}
 	}
 
 	*e = append(*e, &EnvVar{
-		Key:   key,
-		Value: value,
+		Key:     key,
+		Value:   value,
+		Literal: literal,
 	})
 }
 
+// validEnvKey matches names of env vars the shell can export.
+var validEnvKey = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// ResolveValues resolves the values of the env vars using bash, in the
+// order of the list, so they can reference previously defined env vars.
+// References to the var itself or to the later ones, ie. PATH: $PATH:/opt,
+// expand to the local environment. Vars referencing each other in a cycle,
+// ie. A: $B and B: $A, are an error, as the result depends on the order.
+// Command substitutions, ie. $(git rev-parse HEAD), are run locally and
+// fail on non-zero exit status. The remote shell expands $VARs of the
+// resolved values again, ie. of the escaped \$HOME, see EnvVar.Resolved.
 func (e *EnvList) ResolveValues() error {
 	if len(*e) == 0 {
 		return nil
 	}
 
+	for _, v := range *e {
+		if !validEnvKey.MatchString(v.Key) {
+			return fmt.Errorf("invalid env var name %q", v.Key)
+		}
+	}
+	if cycle := e.referenceCycle(); cycle != nil {
+		return fmt.Errorf("env vars reference each other in a cycle: %v", strings.Join(cycle, " -> "))
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+
 	exports := ""
 	for i, v := range *e {
-		exports += v.AsExport()
-
-		cmd := exec.Command("bash", "-c", exports+"echo -n "+v.Value+";")
-		cwd, err := os.Getwd()
+		value, outputs, err := resolveCommandSubstitutions(v.Value, exports, cwd)
 		if err != nil {
-			return err
+			return errors.Wrapf(err, "resolving env var %v failed", v.Key)
 		}
+
+		cmd := exec.Command("bash", "-c", exports+outputs+"echo -n "+value+";")
 		cmd.Dir = cwd
 		resolvedValue, err := cmd.Output()
 		if err != nil {
@@ -231,14 +496,141 @@ func (e *EnvList) ResolveValues() error {
 		}
 
 		(*e)[i].Value = string(resolvedValue)
+		(*e)[i].Resolved = true
+		// The later vars reference the resolved value as is.
+		exports += `export ` + v.Key + `=` + shellQuote(v.Value) + `;`
+	}
+
+	return nil
+}
+
+// envReference matches references to env vars, ie. $FOO or ${FOO}, unless
+// escaped by a backslash.
+var envReference = regexp.MustCompile(`\\?\$\{?([A-Za-z_][A-Za-z0-9_]*)`)
+
+// referenceCycle returns the vars referencing each other in a cycle, the
+// first one repeated at the end, or nil if there's no cycle. References of
+// a var to itself aren't a cycle, they expand to the local environment.
+func (e EnvList) referenceCycle() []string {
+	refs := map[string][]string{}
+	for _, v := range e {
+		refs[v.Key] = nil
+	}
+	for _, v := range e {
+		for _, m := range envReference.FindAllStringSubmatch(v.Value, -1) {
+			if _, ok := refs[m[1]]; ok && m[1] != v.Key && m[0][0] != '\\' {
+				refs[v.Key] = append(refs[v.Key], m[1])
+			}
+		}
 	}
 
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := map[string]int{}
+	var path []string
+	var visit func(key string) []string
+	visit = func(key string) []string {
+		state[key] = visiting
+		path = append(path, key)
+		for _, ref := range refs[key] {
+			switch state[ref] {
+			case visiting:
+				for i, k := range path {
+					if k == ref {
+						return append(append([]string{}, path[i:]...), ref)
+					}
+				}
+			case unvisited:
+				if cycle := visit(ref); cycle != nil {
+					return cycle
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		state[key] = visited
+		return nil
+	}
+	for _, v := range e {
+		if state[v.Key] == unvisited {
+			if cycle := visit(v.Key); cycle != nil {
+				return cycle
+			}
+		}
+	}
 	return nil
 }
 
+// resolveCommandSubstitutions runs all $(...) command substitutions found
+// in value locally and replaces them with references to shell vars of their
+// output, ie. ${__SUP_CS_0}, so the output keeps the quoting context of the
+// substitution. It returns the value and the assignments of the vars.
+// Substitutions escaped by a backslash, ie. \$(hostname), are kept as is.
+func resolveCommandSubstitutions(value, exports, cwd string) (string, string, error) {
+	var resolved, outputs string
+	for n := 0; ; {
+		start := strings.Index(value, "$(")
+		if start == -1 {
+			return resolved + value, outputs, nil
+		}
+		if escaped(value, start) || strings.HasPrefix(value[start:], "$((") { // Escaped, or arithmetic expansion.
+			resolved += value[:start+2]
+			value = value[start+2:]
+			continue
+		}
+
+		// Find the matching closing paren.
+		end, depth := -1, 0
+		for i := start + 1; i < len(value); i++ {
+			if value[i] == '(' {
+				depth++
+			} else if value[i] == ')' {
+				depth--
+				if depth == 0 {
+					end = i
+					break
+				}
+			}
+		}
+		if end == -1 {
+			return "", "", fmt.Errorf("unterminated command substitution %q", value[start:])
+		}
+
+		command := value[start+2 : end]
+		cmd := exec.Command("bash", "-c", exports+command)
+		cmd.Dir = cwd
+		output, err := cmd.Output()
+		if err != nil {
+			if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+				err = errors.New(strings.TrimSpace(string(exitErr.Stderr)))
+			}
+			return "", "", errors.Wrapf(err, "$(%v) failed", command)
+		}
+
+		output = bytes.TrimRight(output, "\n")
+		name := "__SUP_CS_" + strconv.Itoa(n)
+		n++
+		outputs += name + "=" + shellQuote(string(output)) + ";"
+		resolved += value[:start] + "${" + name + "}"
+		value = value[end+1:]
+	}
+}
+
+// escaped reports whether the byte at i of s is escaped by a backslash.
+func escaped(s string, i int) bool {
+	backslashes := 0
+	for i--; i >= 0 && s[i] == '\\'; i-- {
+		backslashes++
+	}
+	return backslashes%2 == 1
+}
+
+// AsExport returns the env vars as bash export statements, in the order of
+// the list, ie. `export FOO="bar"; export BAR='baz'; `. sup prepends it to
+// every command run on the hosts.
 func (e *EnvList) AsExport() string {
-	// Process all ENVs into a string of form
-	// `export FOO="bar"; export BAR="baz";`.
 	exports := ``
 	for _, v := range *e {
 		exports += v.AsExport() + " "
@@ -262,14 +654,106 @@ func (e ErrUnsupportedSupfileVersion) Error() string {
 	return fmt.Sprintf("%v\n\nCheck your Supfile version (available latest version: v0.5)", e.Msg)
 }
 
+// versionLess reports whether version a is older than b. Versions are
+// dot-separated numbers, ie. "0.5" or "1.2.3", optionally prefixed by "v".
+func versionLess(a, b string) (bool, error) {
+	pa, err := parseVersion(a)
+	if err != nil {
+		return false, err
+	}
+	pb, err := parseVersion(b)
+	if err != nil {
+		return false, err
+	}
+	for i := 0; i < len(pa) || i < len(pb); i++ {
+		var na, nb int
+		if i < len(pa) {
+			na = pa[i]
+		}
+		if i < len(pb) {
+			nb = pb[i]
+		}
+		if na != nb {
+			return na < nb, nil
+		}
+	}
+	return false, nil
+}
+
+func parseVersion(version string) ([]int, error) {
+	var parts []int
+	for _, part := range strings.Split(strings.TrimPrefix(version, "v"), ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid version %q", version)
+		}
+		parts = append(parts, n)
+	}
+	return parts, nil
+}
+
 // NewSupfile parses configuration file and returns Supfile or error.
+// The configuration is expected to be YAML, or JSON if it starts with "{".
 func NewSupfile(data []byte) (*Supfile, error) {
 	var conf Supfile
 
+	if isJSON(data) {
+		var err error
+		data, err = jsonToYAML(data)
+		if err != nil {
+			return nil, errors.Wrap(err, "parsing JSON Supfile failed")
+		}
+	}
+
+	// Check the pinned version first, so an old sup doesn't fail
+	// on newer directives with a confusing error.
+	var pin struct {
+		MinVersion string `yaml:"min_version"`
+	}
+	yaml.Unmarshal(data, &pin)
+	if pin.MinVersion != "" {
+		older, err := versionLess(VERSION, pin.MinVersion)
+		if err != nil {
+			return nil, errors.Wrap(err, "min_version")
+		}
+		if older {
+			return nil, ErrMustUpdate{fmt.Sprintf("this Supfile requires sup >= %v, you have %v", pin.MinVersion, VERSION)}
+		}
+	}
+
 	if err := yaml.Unmarshal(data, &conf); err != nil {
 		return nil, err
 	}
 
+	if err := conf.checkDuplicates(); err != nil {
+		return nil, err
+	}
+
+	// Expand host ranges, ie. web[01:10].example.com.
+	for name, network := range conf.Networks.nets {
+		var hosts []string
+		for _, host := range network.Hosts {
+			expanded, err := ExpandHostRange(host)
+			if err != nil {
+				return nil, errors.Wrapf(err, "network %v", name)
+			}
+			hosts = append(hosts, expanded...)
+		}
+		network.Hosts = hosts
+		for group, groupHosts := range network.HostGroups {
+			hosts = nil
+			for _, host := range groupHosts {
+				expanded, err := ExpandHostRange(host)
+				if err != nil {
+					return nil, errors.Wrapf(err, "network %v: host_groups: %v", name, group)
+				}
+				hosts = append(hosts, expanded...)
+			}
+			network.HostGroups[group] = hosts
+		}
+		conf.Networks.nets[name] = network
+	}
+
 	// API backward compatibility. Will be deprecated in v1.0.
 	switch conf.Version {
 	case "":
@@ -327,6 +811,45 @@ func NewSupfile(data []byte) (*Supfile, error) {
 	return &conf, nil
 }
 
+// ErrDuplicateNames is returned by NewSupfile, if networks, commands or
+// targets are defined more than once, or a command and a target share
+// a name.
+type ErrDuplicateNames struct {
+	Names []string
+}
+
+func (e ErrDuplicateNames) Error() string {
+	return "duplicate names in Supfile: " + strings.Join(e.Names, ", ")
+}
+
+// checkDuplicates returns ErrDuplicateNames, if any name is ambiguous.
+func (conf *Supfile) checkDuplicates() error {
+	var dups []string
+	seen := func(kind string, names []string) map[string]bool {
+		m := map[string]bool{}
+		for _, name := range names {
+			if m[name] {
+				dups = append(dups, fmt.Sprintf("%v %q defined twice", kind, name))
+			}
+			m[name] = true
+		}
+		return m
+	}
+	seen("network", conf.Networks.Names)
+	seen("command", conf.Commands.Names)
+	targets := seen("target", conf.Targets.Names)
+	for _, name := range conf.Commands.Names {
+		if targets[name] {
+			dups = append(dups, fmt.Sprintf("%q is both a command and a target", name))
+			delete(targets, name)
+		}
+	}
+	if len(dups) > 0 {
+		return ErrDuplicateNames{dups}
+	}
+	return nil
+}
+
 // ParseInventory runs the inventory command, if provided, and appends
 // the command's output lines to the manually defined list of hosts.
 func (n Network) ParseInventory() ([]string, error) {
@@ -364,3 +887,74 @@ func (n Network) ParseInventory() ([]string, error) {
 	}
 	return hosts, nil
 }
+
+// isJSON reports whether data looks like a JSON object.
+func isJSON(data []byte) bool {
+	data = bytes.TrimSpace(data)
+	return len(data) > 0 && data[0] == '{'
+}
+
+// jsonToYAML converts a JSON document to YAML, so it can be unmarshalled
+// into Supfile. Order of the object keys is preserved, since networks,
+// commands, targets and env vars all depend on it.
+func jsonToYAML(data []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	v, err := decodeJSONValue(dec)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, errors.New("unexpected data after top-level JSON object")
+	}
+	return yaml.Marshal(v)
+}
+
+func decodeJSONValue(dec *json.Decoder) (interface{}, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch tok {
+	case json.Delim('{'):
+		obj := yaml.MapSlice{}
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := decodeJSONValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			obj = append(obj, yaml.MapItem{Key: key, Value: value})
+		}
+		_, err := dec.Token() // Closing "}".
+		return obj, err
+
+	case json.Delim('['):
+		list := []interface{}{}
+		for dec.More() {
+			value, err := decodeJSONValue(dec)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+		}
+		_, err := dec.Token() // Closing "]".
+		return list, err
+
+	case nil:
+		return nil, nil
+	}
+
+	if n, ok := tok.(json.Number); ok {
+		if i, err := n.Int64(); err == nil {
+			return i, nil
+		}
+		return n.Float64()
+	}
+	return tok, nil
+}
@@ -0,0 +1,138 @@
+package sup
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestEnvVarAsExport(t *testing.T) {
+	tests := []struct {
+		name   string
+		v      EnvVar
+		export string
+		remote string // Value of the var on a host whose $HOME is /home/remote.
+	}{
+		{"plain", EnvVar{Key: "A", Value: "bar"}, `export A="bar";`, "bar"},
+		{"expanded", EnvVar{Key: "A", Value: "$HOME/data"}, `export A="$HOME/data";`, "/home/remote/data"},
+		{"literal", EnvVar{Key: "A", Value: "$HOME 'q'", Literal: true}, `export A='$HOME '\''q'\''';`, "$HOME 'q'"},
+		{"resolved", EnvVar{Key: "A", Value: "bar", Resolved: true}, `export A="bar";`, "bar"},
+		{"resolved quotes", EnvVar{Key: "A", Value: `say "hi" \n`, Resolved: true}, `export A="say \"hi\" \\n";`, `say "hi" \n`},
+		{"resolved backticks", EnvVar{Key: "A", Value: "`id`", Resolved: true}, "export A=\"\\`id\\`\";", "`id`"},
+		{"resolved escaped var", EnvVar{Key: "A", Value: "$HOME/data", Resolved: true}, `export A="$HOME/data";`, "/home/remote/data"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			export := tt.v.AsExport()
+			if export != tt.export {
+				t.Errorf("AsExport() = %v, want %v", export, tt.export)
+			}
+			cmd := exec.Command("bash", "-c", export+`printf %s "$A"`)
+			cmd.Env = []string{"HOME=/home/remote"}
+			out, err := cmd.Output()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(out) != tt.remote {
+				t.Errorf("exported %q, want %q", out, tt.remote)
+			}
+		})
+	}
+}
+
+func TestEnvListResolveValues(t *testing.T) {
+	tests := []struct {
+		name    string
+		env     [][2]string
+		want    []string // Resolved values, in order.
+		wantErr string
+	}{
+		{"plain", [][2]string{{"A", "bar"}}, []string{"bar"}, ""},
+		{"earlier var", [][2]string{{"A", "x"}, {"B", "$A/y"}}, []string{"x", "x/y"}, ""},
+		{"braced var", [][2]string{{"A", "x"}, {"B", "${A}y"}}, []string{"x", "xy"}, ""},
+		{"later var", [][2]string{{"A", "[$B]"}, {"B", "x"}}, []string{"[]", "x"}, ""},
+		{"self reference", [][2]string{{"SUP_TEST", "$SUP_TEST:/opt"}}, []string{"local:/opt"}, ""},
+		{"command substitution", [][2]string{{"A", "$(echo hi)"}}, []string{"hi"}, ""},
+		{"double-quoted command substitution", [][2]string{{"VERSION", `"v-$(echo 1)"`}}, []string{"v-1"}, ""},
+		{"command substitution with quotes", [][2]string{{"A", `"[$(echo "it's")]"`}}, []string{"[it's]"}, ""},
+		{"escaped command substitution", [][2]string{{"A", `"\$(hostname)"`}}, []string{"$(hostname)"}, ""},
+		{"earlier var in command substitution", [][2]string{{"A", "x"}, {"B", "$(echo $A)"}}, []string{"x", "x"}, ""},
+		{"escaped var", [][2]string{{"A", `\$HOME/data`}}, []string{"$HOME/data"}, ""},
+		{"quotes", [][2]string{{"A", `"say \"hi\""`}}, []string{`say "hi"`}, ""},
+		{"escaped reference isn't a cycle", [][2]string{{"A", `\$B`}, {"B", "$A"}}, []string{"$B", "$B"}, ""},
+		{"cycle", [][2]string{{"A", "$B"}, {"B", "$A"}}, nil, "env vars reference each other in a cycle: A -> B -> A"},
+		{"long cycle", [][2]string{{"X", "x"}, {"A", "$B"}, {"B", "${C}"}, {"C", "$X$A"}}, nil, "env vars reference each other in a cycle: A -> B -> C -> A"},
+		{"failed command substitution", [][2]string{{"A", "$(exit 3)"}}, nil, "resolving env var A failed: $(exit 3) failed: exit status 3"},
+		{"invalid name", [][2]string{{"1A", "x"}}, nil, `invalid env var name "1A"`},
+	}
+	t.Setenv("SUP_TEST", "local")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var env EnvList
+			for _, kv := range tt.env {
+				env.Set(kv[0], kv[1])
+			}
+			err := env.ResolveValues()
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("expected error %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, v := range env {
+				got = append(got, v.Value)
+				if !v.Resolved {
+					t.Errorf("%v isn't marked as resolved", v.Key)
+				}
+			}
+			if strings.Join(got, "\x00") != strings.Join(tt.want, "\x00") {
+				t.Errorf("resolved %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpandTarget(t *testing.T) {
+	conf, err := NewSupfile([]byte(`
+version: 0.5
+commands:
+  a:
+    run: echo a
+  b:
+    run: echo b
+targets:
+  all: [a, b]
+  newer: [a, future, b]
+  nested: [a, all]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		target  string
+		want    string // Names of the commands.
+		wantErr string
+	}{
+		{"all", "a b", ""},
+		{"newer", "a b", "target newer references unknown command(s) future"},
+		{"nested", "", "target nested references target all, targets can't contain other targets"},
+		{"missing", "", "unknown target missing"},
+	}
+	for _, tt := range tests {
+		cmds, err := conf.ExpandTarget(tt.target)
+		if (err == nil && tt.wantErr != "") || (err != nil && err.Error() != tt.wantErr) {
+			t.Errorf("ExpandTarget(%v) failed with %v, want %q", tt.target, err, tt.wantErr)
+		}
+		var names []string
+		for _, cmd := range cmds {
+			names = append(names, cmd.Name)
+		}
+		if strings.Join(names, " ") != tt.want {
+			t.Errorf("ExpandTarget(%v) = %q, want %q", tt.target, names, tt.want)
+		}
+	}
+}
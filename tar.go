@@ -1,53 +1,234 @@
 package sup
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"os"
 	"os/exec"
+	"path"
+	"path/filepath"
 	"strings"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/pkg/errors"
 )
 
 // Copying dirs/files over SSH using TAR.
 // tar -C . -cvzf - $SRC | ssh $HOST "tar -C $DST -xvzf -"
 
+// DefaultTar is the tar command run locally and on the hosts, unless
+// set by Stackup.Tar.
+const DefaultTar = "tar"
+
 // RemoteTarCommand returns command to be run on remote SSH host
-// to properly receive the created TAR stream.
-// TODO: Check for relative directory.
-func RemoteTarCommand(dir string) string {
-	return fmt.Sprintf("tar -C \"%s\" -xzf -", dir)
+// to properly receive the created TAR stream. With mkdir, the dir
+// is created first, if it doesn't exist.
+func RemoteTarCommand(dir, compress string, mkdir bool) string {
+	return remoteTarCommand(DefaultTar, dir, compress, mkdir)
+}
+
+func remoteTarCommand(tar, dir, compress string, mkdir bool) string {
+	var cmd string
+	if mkdir {
+		cmd = fmt.Sprintf("mkdir -p %s && ", doubleQuote(dir))
+	}
+	if compress == "zstd" {
+		return cmd + fmt.Sprintf("zstd -dcq | %s -C %s -xf -", tar, doubleQuote(dir))
+	}
+	return cmd + fmt.Sprintf("%s -C %s -x%sf -", tar, doubleQuote(dir), tarCompressFlag(compress))
 }
 
-func LocalTarCmdArgs(path, exclude string) []string {
+// doubleQuote quotes s in double quotes, so it's passed to shell as
+// a single word, but env vars like $HOME are still expanded.
+func doubleQuote(s string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "`", "\\`")
+	return `"` + r.Replace(s) + `"`
+}
+
+// intendedDst reports whether the upload destination is absolute, or
+// explicitly relative, ie. "./dir" or "$HOME/dir". A plain relative path,
+// ie. "dir", is extracted to the login dir of the hosts, which is rarely
+// intended.
+func intendedDst(dst string) bool {
+	return path.IsAbs(dst) || strings.HasPrefix(dst, "./") || strings.HasPrefix(dst, "../") ||
+		dst == "." || strings.HasPrefix(dst, "$")
+}
+
+// tarCompressFlag returns the tar flag of the compression. Only gzip is
+// done by tar itself; zstd is compressed by newTarStreamReader, and
+// decompressed by the zstd command on the hosts.
+func tarCompressFlag(compress string) string {
+	switch compress {
+	case "none", "zstd":
+		return ""
+	}
+	return "z"
+}
+
+// ValidCompression reports whether the upload compression is supported.
+func ValidCompression(compress string) bool {
+	switch compress {
+	case "", "gzip", "zstd", "none":
+		return true
+	}
+	return false
+}
+
+func LocalTarCmdArgs(path string, excludes []string, compress string) []string {
+	return localTarCmdArgs(path, excludes, nil, compress)
+}
+
+// localTarCmdArgs returns the tar args like LocalTarCmdArgs. The anchored
+// patterns match the file names from the start only, ie. "./build"
+// doesn't match "./src/build".
+func localTarCmdArgs(path string, excludes, anchored []string, compress string) []string {
 	args := []string{}
 
 	// Added pattens to exclude from tar compress
-	excludes := strings.Split(exclude, ",")
 	for _, exclude := range excludes {
 		trimmed := strings.TrimSpace(exclude)
 		if trimmed != "" {
 			args = append(args, `--exclude=`+trimmed)
 		}
 	}
+	if len(anchored) > 0 {
+		args = append(args, "--anchored")
+		for _, exclude := range anchored {
+			args = append(args, `--exclude=`+exclude)
+		}
+		args = append(args, "--no-anchored")
+	}
 
-	args = append(args, "-C", ".", "-czf", "-", path)
+	args = append(args, "-C", ".", "-c"+tarCompressFlag(compress)+"f", "-", path)
 	return args
 }
 
 // NewTarStreamReader creates a tar stream reader from a local path.
 // TODO: Refactor. Use "archive/tar" instead.
-func NewTarStreamReader(cwd, path, exclude string) (io.Reader, error) {
-	cmd := exec.Command("tar", LocalTarCmdArgs(path, exclude)...)
+func NewTarStreamReader(cwd, path string, excludes []string, compress string) (io.Reader, error) {
+	return newTarStreamReader(DefaultTar, cwd, path, excludes, nil, compress)
+}
+
+// newTarStreamReader creates a tar stream reader by the tar command,
+// ie. "gtar" or "busybox tar". The zstd compression is done in-process.
+// Once the stream is read, the reader returns the error of tar, if it
+// failed, instead of io.EOF. The anchored excludes match the file names
+// from the start only, see IgnorePatterns.
+func newTarStreamReader(tar, cwd, path string, excludes, anchored []string, compress string) (io.Reader, error) {
+	args := strings.Fields(tar)
+	cmd := exec.Command(args[0], append(args[1:], localTarCmdArgs(path, excludes, anchored, compress)...)...)
 	cmd.Dir = cwd
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
 	stdout, err := cmd.StdoutPipe()
 	if err != nil {
 		return nil, errors.Wrap(err, "tar: stdout pipe failed")
 	}
 
+	var zw *zstd.Encoder
+	pr, pw := io.Pipe()
+	var w io.Writer = pw
+	if compress == "zstd" {
+		zw, err = zstd.NewWriter(pw)
+		if err != nil {
+			return nil, errors.Wrap(err, "zstd: creating encoder failed")
+		}
+		w = zw
+	}
+
 	if err := cmd.Start(); err != nil {
 		return nil, errors.Wrap(err, "tar: starting cmd failed")
 	}
 
-	return stdout, nil
+	go func() {
+		_, err := io.Copy(w, stdout)
+		if zw != nil {
+			if e := zw.Close(); err == nil {
+				err = errors.Wrap(e, "zstd: compressing failed")
+			}
+		}
+		// Let tar exit, if the copy failed, so it can be waited for.
+		io.Copy(ioutil.Discard, stdout)
+		if e := cmd.Wait(); e != nil {
+			err = errors.Wrapf(e, "tar: %v", strings.TrimSpace(stderr.String()))
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
+
+// tarReader starts the tar stream on the first Read, so the streams of the
+// groups of clients are started only once their tasks run, and don't keep
+// tar running, if an earlier task fails.
+type tarReader struct {
+	tar      string
+	cwd      string
+	path     string
+	excludes []string
+	anchored []string
+	compress string
+	r        io.Reader
+}
+
+func (r *tarReader) Read(p []byte) (int, error) {
+	if r.r == nil {
+		tr, err := newTarStreamReader(r.tar, r.cwd, r.path, r.excludes, r.anchored, r.compress)
+		if err != nil {
+			return 0, err
+		}
+		r.r = tr
+	}
+	return r.r.Read(p)
+}
+
+// IgnoreFiles are read by IgnorePatterns from the root of the uploaded directory.
+var IgnoreFiles = []string{".gitignore", ".supignore"}
+
+// IgnorePatterns translates the .gitignore and .supignore files found in
+// the dir to tar --exclude patterns. The .git directory is always excluded.
+// The anchored patterns, ie. "/build" or "docs/build", are returned
+// separately, prefixed by the dir, to be matched from the start of the file
+// names only, see newTarStreamReader. Negated patterns (!pattern) aren't
+// supported by tar and are skipped.
+func IgnorePatterns(dir string) (patterns, anchored []string, err error) {
+	patterns = []string{filepath.Join(dir, ".git")}
+	for _, name := range IgnoreFiles {
+		f, err := os.Open(filepath.Join(dir, name))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || line[0] == '#' || line[0] == '!' {
+				continue
+			}
+			// tar matches the patterns at any depth, but directory-only
+			// and the "**/" prefix have no tar equivalent.
+			anyDepth := strings.HasPrefix(line, "**/")
+			line = strings.TrimPrefix(line, "**/")
+			line = strings.TrimSuffix(line, "/")
+			if strings.Trim(line, "/") == "" {
+				continue
+			}
+			if !anyDepth && strings.Contains(line, "/") {
+				// Anchored to the uploaded directory, as named by tar.
+				anchored = append(anchored, strings.TrimSuffix(dir, "/")+"/"+strings.TrimPrefix(line, "/"))
+				continue
+			}
+			patterns = append(patterns, line)
+		}
+		f.Close()
+		if err := scanner.Err(); err != nil {
+			return nil, nil, errors.Wrap(err, name)
+		}
+	}
+	return patterns, anchored, nil
 }
@@ -0,0 +1,82 @@
+package sup
+
+import (
+	"archive/tar"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestIgnorePatterns(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"build/a", "src/build/b", "docs/out/c", "src/docs/out/d", "app.log", "src/app.log", "src/main.go"} {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	gitignore := "# Anchored.\n/build/\ndocs/out\n# Any depth.\n*.log\n# Empty.\n/\n**/\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, ".gitignore"), []byte(gitignore), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The uploaded dir as given, ie. "src: ." or an absolute path.
+	for _, path := range []string{".", dir} {
+		t.Run(path, func(t *testing.T) {
+			patterns, anchored := ignorePatternsIn(t, dir, path)
+			prefix := strings.TrimSuffix(path, "/")
+			if want := prefix + "/build " + prefix + "/docs/out"; strings.Join(anchored, " ") != want {
+				t.Errorf("anchored patterns %q, want %q", anchored, want)
+			}
+
+			r, err := newTarStreamReader(DefaultTar, dir, path, patterns, anchored, "none")
+			if err != nil {
+				t.Fatal(err)
+			}
+			var files []string
+			tr := tar.NewReader(r)
+			for {
+				h, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if h.Typeflag == tar.TypeReg {
+					files = append(files, strings.TrimPrefix(h.Name, strings.TrimPrefix(prefix, "/")+"/"))
+				}
+			}
+			sort.Strings(files)
+			want := ".gitignore src/build/b src/docs/out/d src/main.go"
+			if strings.Join(files, " ") != want {
+				t.Errorf("uploaded %q, want %q", files, want)
+			}
+		})
+	}
+}
+
+// ignorePatternsIn returns the IgnorePatterns of the path, as seen from
+// the dir.
+func ignorePatternsIn(t *testing.T, dir, path string) ([]string, []string) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(cwd)
+	patterns, anchored, err := IgnorePatterns(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return patterns, anchored
+}
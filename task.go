@@ -5,6 +5,9 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
+	"strings"
+	"sync"
 
 	"github.com/pkg/errors"
 )
@@ -15,149 +18,428 @@ type Task struct {
 	Input   io.Reader
 	Clients []Client
 	TTY     bool
+	Login   bool   // Run in a login shell?
+	Shell   string // Run with the shell, instead of the user's default one.
+
+	IgnoreErrors bool // Don't fail on non-zero exit status.
+
+	gated    bool         // Wait for the command's healthcheck after the task.
+	drained  bool         // Drain the task's clients by the command's drain before the task.
+	register string       // Env var to capture STDOUT of the task into.
+	expect   *expectation // STDOUT of the task must meet it, if set.
+	step     string       // Step of the command the task runs, ie. "step 2/3", if any.
 }
 
-func (sup *Stackup) createTasks(cmd *Command, clients []Client, env string) ([]*Task, error) {
+func (sup *Stackup) createTasks(cmd *Command, network *Network, clients []Client, env string) ([]*Task, error) {
 	var tasks []*Task
 
+	serial, err := rolloutSerial(cmd, len(clients))
+	if err != nil {
+		return nil, err
+	}
+	// Limit number of hosts running the command simultaneously, if set.
+	if sup.forks > 0 && sup.forks < len(clients) && (serial == 0 || serial > sup.forks) {
+		serial = sup.forks
+	}
+	groups, err := sup.splitClients(cmd, network, clients, serial)
+	if err != nil {
+		return nil, err
+	}
+
+	login := cmd.Login || network.Login
+	shell := network.Shell
+	if cmd.Shell != "" {
+		shell = cmd.Shell
+	}
+
 	cwd, err := os.Getwd()
 	if err != nil {
 		return nil, errors.Wrap(err, "resolving CWD failed")
 	}
 
-	// Anything to upload?
+	expect, err := newExpectation(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	// STDIN of the command. Every group of clients reads its own copy
+	// of the stdin_file.
+	if cmd.Stdin && cmd.StdinFile != "" {
+		return nil, errors.New("stdin and stdin_file can't be used together")
+	}
+	if cmd.StdinFile != "" {
+		if _, err := os.Stat(cmd.StdinFile); err != nil {
+			return nil, errors.Wrap(err, "stdin_file")
+		}
+	}
+	stdin := func() io.Reader {
+		if cmd.StdinFile != "" {
+			return &fileReader{path: cmd.StdinFile}
+		}
+		if cmd.Stdin {
+			return os.Stdin
+		}
+		return nil
+	}
+
+	// Anything to upload? Make sure the tar commands are there first.
+	localTar, remoteTar := sup.tar()
+	if len(cmd.Upload) > 0 {
+		if _, err := exec.LookPath(strings.Fields(localTar)[0]); err != nil {
+			return nil, fmt.Errorf("upload: %v not found locally, set SUP_TAR to the tar command", localTar)
+		}
+		if remoteTar != DefaultTar {
+			if hosts := sup.missingOn(clients, shell, strings.Fields(remoteTar)[0]); len(hosts) > 0 {
+				return nil, fmt.Errorf("upload: %v not found on %v, set SUP_REMOTE_TAR to the tar command of the hosts", remoteTar, strings.Join(hosts, ", "))
+			}
+		}
+	}
 	for _, upload := range cmd.Upload {
+		if upload.Dst == "" {
+			return nil, fmt.Errorf("upload: %v: dst is empty", upload.Src)
+		}
+		if !intendedDst(upload.Dst) {
+			sup.log(LogEntry{
+				Level:   LogWarn,
+				Message: fmt.Sprintf("upload: %v: dst %q is relative to the login dir of the hosts, prefix it by ./ to silence this warning", upload.Src, upload.Dst),
+				Command: cmd.Name,
+			})
+		}
 		uploadFile, err := ResolveLocalPath(cwd, upload.Src, env)
 		if err != nil {
 			return nil, errors.Wrap(err, "upload: "+upload.Src)
 		}
-		uploadTarReader, err := NewTarStreamReader(cwd, uploadFile, upload.Exc)
-		if err != nil {
-			return nil, errors.Wrap(err, "upload: "+upload.Src)
+		excludes := upload.Exc
+		var anchored []string
+		if upload.UseGitignore {
+			if info, err := os.Stat(uploadFile); err == nil && info.IsDir() {
+				patterns, anchoredPatterns, err := IgnorePatterns(uploadFile)
+				if err != nil {
+					return nil, errors.Wrap(err, "upload: "+upload.Src)
+				}
+				excludes = append(patterns, excludes...)
+				anchored = anchoredPatterns
+			}
+		}
+		if !ValidCompression(upload.Compress) {
+			return nil, fmt.Errorf("upload: %v: unknown compress %q, expected gzip, zstd or none", upload.Src, upload.Compress)
+		}
+		compress := upload.Compress
+		if compress == "zstd" && !sup.zstdSupported(clients, shell) {
+			sup.log(LogEntry{
+				Level:   LogWarn,
+				Message: fmt.Sprintf("upload: %v: zstd not found on some hosts, using gzip", upload.Src),
+				Command: cmd.Name,
+			})
+			compress = "gzip"
+		}
+		// Named uploads record their checksum on the hosts, so run_if_changed
+		// commands know which hosts they changed.
+		var record string
+		if upload.Name != "" {
+			checksum, err := uploadChecksum(localTar, cwd, uploadFile, excludes, anchored)
+			if err != nil {
+				return nil, errors.Wrap(err, "upload: "+upload.Src)
+			}
+			state := uploadStatePath(upload.Name, upload.Dst)
+			uploadClients := clients
+			if cmd.Once {
+				uploadClients = clients[:1]
+			}
+			sup.detectChanges(upload.Name, uploadClients, shell, state, checksum)
+			record = recordChecksum(state, checksum)
 		}
 
 		task := Task{
-			Run:   RemoteTarCommand(upload.Dst),
-			Input: uploadTarReader,
+			Run:   remoteTarCommand(remoteTar, upload.Dst, compress, upload.Mkdir) + record,
 			TTY:   false,
+			Shell: shell,
+		}
+		tarInput := func() io.Reader {
+			return &tarReader{tar: localTar, cwd: cwd, path: uploadFile, excludes: excludes, anchored: anchored, compress: compress}
 		}
 
 		if cmd.Once {
 			task.Clients = []Client{clients[0]}
+			task.Input = tarInput()
 			tasks = append(tasks, &task)
-		} else if cmd.Serial > 0 {
-			// Each "serial" task client group is executed sequentially.
-			for i := 0; i < len(clients); i += cmd.Serial {
-				j := i + cmd.Serial
-				if j > len(clients) {
-					j = len(clients)
-				}
+		} else {
+			// Each task client group is executed sequentially
+			// and reads its own tar stream, started once the task runs.
+			for _, group := range groups {
 				copy := task
-				copy.Clients = clients[i:j]
+				copy.Clients = group.clients
+				copy.Input = tarInput()
 				tasks = append(tasks, &copy)
 			}
-		} else {
-			task.Clients = clients
-			tasks = append(tasks, &task)
 		}
 	}
 
-	// Script. Read the file as a multiline input command.
+	// Script. Stream the file to the remote shell's STDIN, unless the STDIN
+	// or pseudo terminal is needed by the script itself. In such case, read
+	// the file as a multiline input command.
 	if cmd.Script != "" {
 		f, err := os.Open(cmd.Script)
 		if err != nil {
 			return nil, errors.Wrap(err, "can't open script")
 		}
-		data, err := ioutil.ReadAll(f)
-		if err != nil {
-			return nil, errors.Wrap(err, "can't read script")
-		}
+		f.Close()
 
 		task := Task{
-			Run: string(data),
-			TTY: true,
+			TTY:      sup.tty(cmd),
+			Login:    login,
+			Shell:    shell,
+			gated:    cmd.Healthcheck != nil,
+			drained:  cmd.Drain != nil,
+			register: cmd.Register,
+			expect:   expect,
 		}
-		if sup.debug {
-			task.Run = "set -x;" + task.Run
+		stream := !cmd.Stdin && cmd.StdinFile == "" && !(task.TTY && cmd.TTY != nil)
+		if stream {
+			task.Run = `"${SHELL:-/bin/sh}" -s`
+			if shell != "" {
+				task.Run = shell + " -s"
+			}
+			task.TTY = false // Terminal would mangle the script.
+		} else {
+			data, err := ioutil.ReadFile(cmd.Script)
+			if err != nil {
+				return nil, errors.Wrap(err, "can't read script")
+			}
+			task.Run = string(data)
+			if sup.trace(cmd) {
+				task.Run = "set -x;" + task.Run
+			}
 		}
-		if cmd.Stdin {
-			task.Input = os.Stdin
+
+		// Every group of clients reads its own copy of the script.
+		scriptInput := func() io.Reader {
+			if !stream {
+				return stdin()
+			}
+			var header string
+			if sup.trace(cmd) {
+				header = "set -x\n"
+			}
+			return io.MultiReader(strings.NewReader(header), &fileReader{path: cmd.Script})
 		}
+
 		if cmd.Once {
 			task.Clients = []Client{clients[0]}
+			task.Input = scriptInput()
 			tasks = append(tasks, &task)
-		} else if cmd.Serial > 0 {
-			// Each "serial" task client group is executed sequentially.
-			for i := 0; i < len(clients); i += cmd.Serial {
-				j := i + cmd.Serial
-				if j > len(clients) {
-					j = len(clients)
-				}
+		} else {
+			// Each task client group is executed sequentially.
+			for _, group := range groups {
 				copy := task
-				copy.Clients = clients[i:j]
+				copy.Clients = group.clients
+				copy.Run = group.env + copy.Run
+				copy.Input = scriptInput()
 				tasks = append(tasks, &copy)
 			}
-		} else {
-			task.Clients = clients
-			tasks = append(tasks, &task)
 		}
 	}
 
 	// Local command.
 	if cmd.Local != "" {
+		localEnv := env + `export SUP_HOST="localhost";`
+		if sup.noEnv {
+			localEnv = ""
+		}
 		local := &LocalhostClient{
-			env: env + `export SUP_HOST="localhost";`,
+			env:   localEnv,
+			state: sup.localState,
 		}
 		local.Connect("localhost")
 		task := &Task{
 			Run:     cmd.Local,
 			Clients: []Client{local},
-			TTY:     true,
+			TTY:     sup.tty(cmd),
+			Login:   login,
+			Shell:   cmd.Shell, // Network's shell is meant for the remote hosts only.
+			expect:  expect,
 		}
-		if sup.debug {
+		if sup.trace(cmd) {
 			task.Run = "set -x;" + task.Run
 		}
-		if cmd.Stdin {
-			task.Input = os.Stdin
-		}
+		task.Input = stdin()
 		tasks = append(tasks, task)
 	}
 
 	// Remote command.
 	if cmd.Run != "" {
 		task := Task{
-			Run: cmd.Run,
-			TTY: true,
+			Run:      cmd.Run,
+			TTY:      sup.tty(cmd),
+			Login:    login,
+			Shell:    shell,
+			gated:    cmd.Healthcheck != nil,
+			drained:  cmd.Drain != nil,
+			register: cmd.Register,
+			expect:   expect,
 		}
-		if sup.debug {
+		if sup.trace(cmd) {
 			task.Run = "set -x;" + task.Run
 		}
-		if cmd.Stdin {
-			task.Input = os.Stdin
-		}
 		if cmd.Once {
 			task.Clients = []Client{clients[0]}
+			task.Input = stdin()
 			tasks = append(tasks, &task)
-		} else if cmd.Serial > 0 {
-			// Each "serial" task client group is executed sequentially.
-			for i := 0; i < len(clients); i += cmd.Serial {
-				j := i + cmd.Serial
-				if j > len(clients) {
-					j = len(clients)
-				}
+		} else {
+			// Each task client group is executed sequentially.
+			for _, group := range groups {
 				copy := task
-				copy.Clients = clients[i:j]
+				copy.Clients = group.clients
+				copy.Run = group.env + copy.Run
+				copy.Input = stdin()
 				tasks = append(tasks, &copy)
 			}
-		} else {
-			task.Clients = clients
-			tasks = append(tasks, &task)
 		}
 	}
 
+	// Steps. Each step is a task of its own, run by each group of clients
+	// in order, so the failed step is reported.
+	if len(cmd.Steps) > 0 {
+		stepGroups := groups
+		if cmd.Once {
+			stepGroups = []clientGroup{{clients: []Client{clients[0]}}}
+		}
+		for _, group := range stepGroups {
+			for i, step := range cmd.Steps {
+				task := &Task{
+					Run:     group.env + step,
+					Clients: group.clients,
+					TTY:     sup.tty(cmd),
+					Login:   login,
+					Shell:   shell,
+					gated:   cmd.Healthcheck != nil && i == len(cmd.Steps)-1,
+					drained: cmd.Drain != nil && i == 0,
+					step:    fmt.Sprintf("step %v/%v %q", i+1, len(cmd.Steps), step),
+				}
+				if i == len(cmd.Steps)-1 {
+					task.expect = expect
+				}
+				if sup.trace(cmd) {
+					task.Run = "set -x;" + task.Run
+				}
+				task.Input = stdin()
+				tasks = append(tasks, task)
+			}
+		}
+	}
+
+	// Drain each group of clients only before its first task, not before
+	// each of the script, run and steps tasks of the group.
+	drained := map[Client]bool{}
+	for _, task := range tasks {
+		if task.drained {
+			task.drained = !drained[task.Clients[0]]
+			drained[task.Clients[0]] = true
+		}
+	}
+
+	for _, task := range tasks {
+		// Redirect STDERR to STDOUT on the host, so the order of the output lines is kept.
+		if sup.mergeStderr {
+			task.Run = "exec 2>&1; " + task.Run
+		}
+		task.IgnoreErrors = cmd.IgnoreErrors
+	}
+
 	return tasks, nil
 }
 
+// zstdSupported reports whether the zstd command is available on all the
+// clients, to decompress the uploads. They're compressed in-process.
+func (sup *Stackup) zstdSupported(clients []Client, shell string) bool {
+	return len(sup.missingOn(clients, shell, "zstd")) == 0
+}
+
+// missingOn returns the hosts of the clients the command isn't found on.
+func (sup *Stackup) missingOn(clients []Client, shell string, command string) []string {
+	var wg sync.WaitGroup
+	errs := make([]error, len(clients))
+	for i, c := range clients {
+		wg.Add(1)
+		go func(i int, c Client) {
+			defer wg.Done()
+			task := &Task{
+				Run:     "command -v " + shellQuote(command),
+				Clients: []Client{c},
+				Shell:   shell,
+			}
+			if errs[i] = c.Run(task); errs[i] != nil {
+				return
+			}
+			go io.Copy(ioutil.Discard, c.Stdout())
+			go io.Copy(ioutil.Discard, c.Stderr())
+			errs[i] = c.Wait()
+		}(i, c)
+	}
+	wg.Wait()
+
+	var hosts []string
+	for i, err := range errs {
+		if err != nil {
+			hosts = append(hosts, clientHost(clients[i]))
+		}
+	}
+	return hosts
+}
+
+// fileReader opens the file on the first Read and closes it on EOF,
+// so the file isn't held in memory nor open longer than needed.
+type fileReader struct {
+	path string
+	f    *os.File
+	err  error
+}
+
+func (r *fileReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if r.f == nil {
+		if r.f, r.err = os.Open(r.path); r.err != nil {
+			return 0, r.err
+		}
+	}
+	n, err := r.f.Read(p)
+	if err != nil {
+		r.f.Close()
+		r.err = err
+	}
+	return n, err
+}
+
+// tty reports whether the command's tasks should request a pseudo terminal.
+func (sup *Stackup) tty(cmd *Command) bool {
+	if sup.noTTY {
+		return false
+	}
+	if cmd.TTY != nil {
+		return *cmd.TTY
+	}
+	return true
+}
+
+// trace reports whether the command's tasks should be traced by "set -x",
+// ie. in debug mode, unless the command opts out by debug: false.
+func (sup *Stackup) trace(cmd *Command) bool {
+	if !sup.debug {
+		return false
+	}
+	if cmd.Debug != nil {
+		return *cmd.Debug
+	}
+	return true
+}
+
+// shellQuote quotes s, so it's passed to shell as a single word.
+func shellQuote(s string) string {
+	return `'` + strings.Replace(s, `'`, `'\''`, -1) + `'`
+}
+
 type ErrTask struct {
 	Task   *Task
 	Reason string
@@ -0,0 +1,249 @@
+package sup
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// List returns the commands in the Supfile order, with their names set.
+func (c *Commands) List() []Command {
+	cmds := make([]Command, 0, len(c.Names))
+	for _, name := range c.Names {
+		cmd := c.cmds[name]
+		cmd.Name = name
+		cmds = append(cmds, cmd)
+	}
+	return cmds
+}
+
+// ErrUnknownCommands is returned by ExpandTarget, if the target references
+// commands the Supfile doesn't define, ie. the commands of a newer sup.
+type ErrUnknownCommands struct {
+	Target   string
+	Commands []string
+}
+
+func (e ErrUnknownCommands) Error() string {
+	return fmt.Sprintf("target %v references unknown command(s) %v", e.Target, strings.Join(e.Commands, ", "))
+}
+
+// ExpandTarget returns the commands of the given target in order, with
+// their names set. If the target references unknown commands, it returns
+// the known ones along with ErrUnknownCommands, so they can be run anyway.
+func (conf *Supfile) ExpandTarget(name string) ([]Command, error) {
+	names, ok := conf.Targets.Get(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown target %v", name)
+	}
+
+	cmds := make([]Command, 0, len(names))
+	var unknown []string
+	for _, cmdName := range names {
+		cmd, ok := conf.Commands.Get(cmdName)
+		if !ok {
+			if _, isTarget := conf.Targets.Get(cmdName); isTarget {
+				return nil, fmt.Errorf("target %v references target %v, targets can't contain other targets", name, cmdName)
+			}
+			unknown = append(unknown, cmdName)
+			continue
+		}
+		cmd.Name = cmdName
+		cmds = append(cmds, cmd)
+	}
+	if len(unknown) > 0 {
+		return cmds, ErrUnknownCommands{Target: name, Commands: unknown}
+	}
+	return cmds, nil
+}
+
+// ResolveHosts returns the network's hosts, followed by the hosts of its
+// inventory command and inventory file, if any.
+func (n Network) ResolveHosts() ([]string, error) {
+	hosts := append([]string{}, n.Hosts...)
+
+	inventoryHosts, err := n.ParseInventory()
+	if err != nil {
+		return nil, err
+	}
+	hosts = append(hosts, inventoryHosts...)
+
+	inventoryHosts, err = n.ParseInventoryFile()
+	if err != nil {
+		return nil, err
+	}
+	return append(hosts, inventoryHosts...), nil
+}
+
+// Validate checks the Supfile for errors without connecting to any host
+// or running any command. It returns all the errors found.
+func (conf *Supfile) Validate() []error {
+	var errs []error
+
+	for _, name := range conf.Networks.Names {
+		network, _ := conf.Networks.Get(name)
+		if len(network.Hosts) == 0 && network.Inventory == "" && network.InventoryFile == "" {
+			errs = append(errs, fmt.Errorf("network %v: no hosts defined", name))
+		}
+		if network.DialHost != "" && network.DialHostCommand != "" {
+			errs = append(errs, fmt.Errorf("network %v: both dial_host and dial_host_command defined", name))
+		}
+		var groups []string
+		for group := range network.HostGroups {
+			groups = append(groups, group)
+		}
+		sort.Strings(groups)
+		groupOf := map[string]string{}
+		for _, group := range groups {
+			for _, host := range network.HostGroups[group] {
+				if other, ok := groupOf[host]; ok {
+					errs = append(errs, fmt.Errorf("network %v: host %v is in both host_groups %v and %v", name, host, other, group))
+				}
+				groupOf[host] = group
+			}
+		}
+		for _, path := range network.EnvFile {
+			if len(path) > 0 && path[0] == '-' {
+				continue
+			}
+			if _, err := os.Stat(path); err != nil {
+				errs = append(errs, errors.Wrapf(err, "network %v: env_file", name))
+			}
+		}
+	}
+
+	uploads := map[string]bool{}
+	for _, cmd := range conf.Commands.List() {
+		for _, upload := range cmd.Upload {
+			if upload.Name != "" {
+				uploads[upload.Name] = true
+			}
+		}
+	}
+
+	for _, cmd := range conf.Commands.List() {
+		if cmd.Run == "" && cmd.Local == "" && cmd.Script == "" && len(cmd.Steps) == 0 && len(cmd.Upload) == 0 {
+			errs = append(errs, fmt.Errorf("command %v: nothing to run, set run, local, script, steps or upload", cmd.Name))
+		}
+		for i, step := range cmd.Steps {
+			if step == "" {
+				errs = append(errs, fmt.Errorf("command %v: steps[%v] is empty", cmd.Name, i))
+			}
+		}
+		if cmd.Serial < 0 {
+			errs = append(errs, fmt.Errorf("command %v: serial must not be negative", cmd.Name))
+		}
+		if cmd.GroupSerial < 0 {
+			errs = append(errs, fmt.Errorf("command %v: group_serial must not be negative", cmd.Name))
+		}
+		if cmd.MaxUnavailable != "" {
+			if _, err := parseCount(cmd.MaxUnavailable, 1); err != nil {
+				errs = append(errs, fmt.Errorf("command %v: max_unavailable: %v", cmd.Name, err))
+			}
+		}
+		if cmd.MinHealthy != "" {
+			if _, err := parseCount(cmd.MinHealthy, 1); err != nil {
+				errs = append(errs, fmt.Errorf("command %v: min_healthy: %v", cmd.Name, err))
+			}
+		}
+		for i, batch := range cmd.Batches {
+			if _, err := parseCount(batch.Hosts, 1); err != nil {
+				errs = append(errs, fmt.Errorf("command %v: batches[%v]: %v", cmd.Name, i, err))
+			}
+		}
+		if cmd.Register != "" && !isEnvName(cmd.Register) {
+			errs = append(errs, fmt.Errorf("command %v: register: invalid env var name %q", cmd.Name, cmd.Register))
+		}
+		if cmd.Register != "" && cmd.Run == "" && cmd.Script == "" {
+			errs = append(errs, fmt.Errorf("command %v: register needs run or script", cmd.Name))
+		}
+		if _, err := newExpectation(&cmd); err != nil {
+			errs = append(errs, errors.Wrapf(err, "command %v", cmd.Name))
+		}
+		if cmd.Healthcheck != nil && cmd.Healthcheck.Run == "" {
+			errs = append(errs, fmt.Errorf("command %v: healthcheck needs run", cmd.Name))
+		}
+		if d := cmd.Drain; d != nil {
+			if d.Run == "" && d.Poll == "" {
+				errs = append(errs, fmt.Errorf("command %v: drain needs run or poll", cmd.Name))
+			}
+			if d.Threshold < 0 || d.Interval < 0 || d.Timeout < 0 {
+				errs = append(errs, fmt.Errorf("command %v: drain threshold, interval and timeout can't be negative", cmd.Name))
+			}
+			if cmd.Run == "" && cmd.Script == "" && len(cmd.Steps) == 0 {
+				errs = append(errs, fmt.Errorf("command %v: drain needs run, script or steps", cmd.Name))
+			}
+		}
+		if cmd.Script != "" {
+			if _, err := os.Stat(cmd.Script); err != nil {
+				errs = append(errs, errors.Wrapf(err, "command %v: script", cmd.Name))
+			}
+		}
+		if cmd.StdinFile != "" {
+			if cmd.Stdin {
+				errs = append(errs, fmt.Errorf("command %v: stdin and stdin_file can't be used together", cmd.Name))
+			}
+			if _, err := os.Stat(cmd.StdinFile); err != nil {
+				errs = append(errs, errors.Wrapf(err, "command %v: stdin_file", cmd.Name))
+			}
+		}
+		if cmd.RunIfChanged != "" && !uploads[cmd.RunIfChanged] {
+			errs = append(errs, fmt.Errorf("command %v: run_if_changed: unknown upload %v", cmd.Name, cmd.RunIfChanged))
+		}
+		for _, upload := range cmd.Upload {
+			if upload.Src == "" || upload.Dst == "" {
+				errs = append(errs, fmt.Errorf("command %v: upload needs both src and dst", cmd.Name))
+			}
+			if !ValidCompression(upload.Compress) {
+				errs = append(errs, fmt.Errorf("command %v: upload: unknown compress %q", cmd.Name, upload.Compress))
+			}
+		}
+		for _, network := range cmd.Networks {
+			n, ok := conf.Networks.Get(network)
+			if !ok {
+				errs = append(errs, fmt.Errorf("command %v: unknown network %v", cmd.Name, network))
+			} else if cmd.OnBastion && n.Bastion == "" {
+				errs = append(errs, fmt.Errorf("command %v: on_bastion, but network %v has no bastion", cmd.Name, network))
+			}
+		}
+	}
+
+	if conf.DefaultNetwork != "" {
+		if _, ok := conf.Networks.Get(conf.DefaultNetwork); !ok {
+			errs = append(errs, fmt.Errorf("default_network: unknown network %v", conf.DefaultNetwork))
+		}
+	}
+	if conf.DefaultCommand != "" {
+		_, isCommand := conf.Commands.Get(conf.DefaultCommand)
+		_, isTarget := conf.Targets.Get(conf.DefaultCommand)
+		if !isCommand && !isTarget {
+			errs = append(errs, fmt.Errorf("default_command: unknown command/target %v", conf.DefaultCommand))
+		}
+	}
+
+	for _, name := range conf.Targets.Names {
+		cmds, err := conf.ExpandTarget(name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if len(cmds) == 0 {
+			errs = append(errs, fmt.Errorf("target %v: no commands defined", name))
+		}
+	}
+
+	return errs
+}
+
+// isEnvName reports whether the name is a valid shell variable name.
+func isEnvName(name string) bool {
+	for i, r := range name {
+		if r != '_' && !(r >= 'a' && r <= 'z') && !(r >= 'A' && r <= 'Z') && !(i > 0 && r >= '0' && r <= '9') {
+			return false
+		}
+	}
+	return name != ""
+}